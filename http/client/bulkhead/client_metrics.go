@@ -0,0 +1,94 @@
+package bulkhead
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+
+	"github.com/treussart/articles/http/client/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Stats contains accumulated stats.
+type Stats struct {
+	Rejected metric.Float64Counter
+	InFlight metric.Int64ObservableGauge
+	Queued   metric.Int64ObservableGauge
+
+	mu       sync.Mutex
+	observed map[*compartments]string
+}
+
+func GetStats(name string) (*Stats, error) {
+	meter := otel.GetMeterProvider().Meter(name)
+	rejected, err := meter.Float64Counter(metrics.Namespace+"client_http_bulkhead_rejected_total",
+		metric.WithDescription("Total number of requests rejected by the bulkhead"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("meter.Float64Counter: %w", err)
+	}
+
+	inFlight, err := meter.Int64ObservableGauge(metrics.Namespace+"client_http_bulkhead_inflight",
+		metric.WithDescription("Current number of in-flight requests per host"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("meter.Int64ObservableGauge: %w", err)
+	}
+
+	queued, err := meter.Int64ObservableGauge(metrics.Namespace+"client_http_bulkhead_queued",
+		metric.WithDescription("Current number of requests waiting in the bulkhead queue per host"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("meter.Int64ObservableGauge: %w", err)
+	}
+
+	stats := &Stats{
+		Rejected: rejected,
+		InFlight: inFlight,
+		Queued:   queued,
+	}
+	_, err = meter.RegisterCallback(stats.observe, inFlight, queued)
+	if err != nil {
+		return nil, fmt.Errorf("meter.RegisterCallback: %w", err)
+	}
+	return stats, nil
+}
+
+// Observe reports the in-flight and queued requests of t with the InFlight and Queued gauges, until unregister is called.
+// Stats doesn't reference t, only its compartments.
+func (s *Stats) Observe(t *Transport) (unregister func()) {
+	t.init()
+	c := t.compartments
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.observed == nil {
+		s.observed = make(map[*compartments]string)
+	}
+	s.observed[c] = t.ModuleName
+	return sync.OnceFunc(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.observed, c)
+	})
+}
+
+func (s *Stats) observe(_ context.Context, observer metric.Observer) error {
+	s.mu.Lock()
+	observed := maps.Clone(s.observed)
+	s.mu.Unlock()
+
+	for c, moduleName := range observed {
+		c.each(func(host string, c *compartment) {
+			attributes := metric.WithAttributes(
+				attribute.String(metrics.PKGLabelName, moduleName),
+				attribute.String(metrics.HostLabelName, host),
+			)
+			observer.ObserveInt64(s.InFlight, c.inFlight.Load(), attributes)
+			observer.ObserveInt64(s.Queued, c.queued.Load(), attributes)
+		})
+	}
+	return nil
+}
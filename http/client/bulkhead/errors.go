@@ -0,0 +1,5 @@
+package bulkhead
+
+import "errors"
+
+var ErrBulkheadFull = errors.New("bulkhead full")
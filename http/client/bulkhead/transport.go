@@ -0,0 +1,174 @@
+package bulkhead
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/treussart/articles/http/client/internal/body"
+	"github.com/treussart/articles/http/client/internal/cleanup"
+	"github.com/treussart/articles/http/client/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	api "go.opentelemetry.io/otel/metric"
+)
+
+const (
+	// ReasonFull counts the requests rejected because the queue is full.
+	ReasonFull = "full"
+	// ReasonQueueTimeout counts the requests rejected after waiting QueueTimeout in the queue.
+	ReasonQueueTimeout = "queue_timeout"
+)
+
+// Transport limits the in-flight requests per host, so a slow upstream can't hold an unbounded
+// number of requests and goroutines. Requests over the limit wait in a bounded queue, or are rejected
+// with ErrBulkheadFull.
+type Transport struct {
+	Tripper http.RoundTripper
+	// MaxInFlight is the maximum number of in-flight requests per host, a request is in-flight
+	// until its response body is closed.
+	MaxInFlight int
+	// MaxQueue is the maximum number of requests waiting per host, 0 to reject the requests over MaxInFlight,
+	// negative for an unbounded queue.
+	MaxQueue int
+	// QueueTimeout is the maximum time a request waits in the queue, 0 to wait until its context is done.
+	QueueTimeout time.Duration
+	Stats        *Stats
+	ModuleName   string
+
+	once         sync.Once
+	compartments *compartments
+	observeOnce  sync.Once
+	observation  *cleanup.Handle
+}
+
+// compartment is the bulkhead of a host.
+type compartment struct {
+	slots    chan struct{}
+	inFlight atomic.Int64
+	queued   atomic.Int64
+}
+
+// compartments are the bulkheads of the hosts of a transport, observed by Stats without the transport
+// so it can be garbage collected.
+type compartments struct {
+	mu    sync.Mutex
+	hosts map[string]*compartment
+}
+
+// each calls f with the compartments of the hosts.
+func (c *compartments) each(f func(host string, c *compartment)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for host, compartment := range c.hosts {
+		f(host, compartment)
+	}
+}
+
+func (t *Transport) init() {
+	t.once.Do(func() {
+		t.compartments = &compartments{hosts: make(map[string]*compartment)}
+	})
+}
+
+func (t *Transport) compartment(host string) *compartment {
+	t.observeOnce.Do(func() {
+		if t.Stats != nil {
+			// The compartments are observed until the transport is garbage collected.
+			t.observation = cleanup.New(t.Stats.Observe(t))
+		}
+	})
+	t.init()
+	t.compartments.mu.Lock()
+	defer t.compartments.mu.Unlock()
+	c, ok := t.compartments.hosts[host]
+	if !ok {
+		c = &compartment{slots: make(chan struct{}, t.MaxInFlight)}
+		t.compartments.hosts[host] = c
+	}
+	return c
+}
+
+func (t *Transport) recordRejected(host, reason string) {
+	if t.Stats != nil {
+		t.Stats.Rejected.Add(context.Background(), 1, api.WithAttributes(
+			attribute.String(metrics.PKGLabelName, t.ModuleName),
+			attribute.String(metrics.HostLabelName, host),
+			attribute.String(metrics.ReasonLabelName, reason)))
+	}
+}
+
+// acquire takes a slot of c, waiting in the queue if there is room.
+func (t *Transport) acquire(ctx context.Context, host string, c *compartment) error {
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if c.queued.Add(1) > int64(t.MaxQueue) && t.MaxQueue >= 0 {
+		c.queued.Add(-1)
+		t.recordRejected(host, ReasonFull)
+		return fmt.Errorf("%w: %s", ErrBulkheadFull, host)
+	}
+	defer c.queued.Add(-1)
+	var timeout <-chan time.Time
+	if t.QueueTimeout > 0 {
+		timer := time.NewTimer(t.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		t.recordRejected(host, ReasonQueueTimeout)
+		return fmt.Errorf("%w: %s: queue timeout", ErrBulkheadFull, host)
+	case <-ctx.Done():
+		return fmt.Errorf("ctx.Done: %w", ctx.Err())
+	}
+}
+
+// RoundTrip implements http.RoundTripper interface.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.MaxInFlight <= 0 {
+		res, err := t.Tripper.RoundTrip(req)
+		if err != nil {
+			return nil, fmt.Errorf("t.Tripper.RoundTrip: %w", err)
+		}
+		return res, nil
+	}
+	host := req.URL.Host
+	c := t.compartment(host)
+	if err := t.acquire(req.Context(), host, c); err != nil {
+		return nil, fmt.Errorf("t.acquire: %w", err)
+	}
+	c.inFlight.Add(1)
+	release := sync.OnceFunc(func() {
+		c.inFlight.Add(-1)
+		<-c.slots
+	})
+
+	res, err := t.Tripper.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("t.Tripper.RoundTrip: %w", err)
+	}
+	// A response without body, e.g. from a Fallback, has nothing to close.
+	if res.Body == nil {
+		release()
+		return res, nil
+	}
+	// The slot is released when the response body is closed.
+	res.Body = body.OnClose(res.Body, release)
+	return res, nil
+}
+
+// CloseIdleConnections closes the idle connections of Tripper, if it supports it.
+func (t *Transport) CloseIdleConnections() {
+	if tr, ok := t.Tripper.(interface{ CloseIdleConnections() }); ok {
+		tr.CloseIdleConnections()
+	}
+}
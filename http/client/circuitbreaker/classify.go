@@ -0,0 +1,30 @@
+package circuitbreaker
+
+import (
+	"context"
+	"errors"
+	"slices"
+)
+
+// IsSuccessful returns a classifier for gobreaker.Settings.IsSuccessful.
+// Failures are the transport errors and the responses having a status code greater than
+// or equal to statusCodeMax or listed in failureStatusCodes (e.g. 429).
+// Other responses, such as 4xx, are successes.
+func IsSuccessful(statusCodeMax int, failureStatusCodes ...int) func(err error) bool {
+	return func(err error) bool {
+		if err == nil {
+			return true
+		}
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			return statusErr.StatusCode < statusCodeMax && !slices.Contains(failureStatusCodes, statusErr.StatusCode)
+		}
+		return false
+	}
+}
+
+// IsExcluded is the default gobreaker.Settings.IsExcluded: the cancellations by the caller are neither
+// successes nor failures, so a cancelled half-open probe does not close the circuit breaker.
+func IsExcluded(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
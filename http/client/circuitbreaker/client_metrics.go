@@ -1,10 +1,13 @@
 package circuitbreaker
 
 import (
+	"context"
 	"fmt"
+	"sync"
 
 	"github.com/treussart/articles/http/client/metrics"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 )
 
@@ -12,26 +15,106 @@ import (
 type Stats struct {
 	CBOpen            metric.Float64Counter
 	CBTooManyRequests metric.Float64Counter
+	CBTransitions     metric.Float64Counter
+	CBFallback        metric.Float64Counter
+	CBState           metric.Int64ObservableGauge
+
+	mu       sync.Mutex
+	observed map[observed]int
+}
+
+// observed is a registry whose circuit breakers states are reported by the CBState gauge.
+type observed struct {
+	registry   *Registry
+	moduleName string
 }
 
 func GetStats(name string) (*Stats, error) {
 	meter := otel.GetMeterProvider().Meter(name)
 	cbOpen, err := meter.Float64Counter(metrics.Namespace+"client_http_cbopen_total",
-		metric.WithDescription("Total number of circuit-breaker openings"),
+		metric.WithDescription("Total number of requests rejected by an open circuit-breaker"),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("meter.Float64Counter: %w", err)
 	}
 
 	cbTooManyRequests, err := meter.Float64Counter(metrics.Namespace+"client_http_cbtoomanyrequests_total",
-		metric.WithDescription("Total number of circuit-breaker openings"),
+		metric.WithDescription("Total number of requests rejected by a half-open circuit-breaker having too many requests"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("meter.Float64Counter: %w", err)
+	}
+
+	cbTransitions, err := meter.Float64Counter(metrics.Namespace+"client_http_cbtransitions_total",
+		metric.WithDescription("Total number of circuit-breaker state transitions"),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("meter.Float64Counter: %w", err)
 	}
 
-	return &Stats{
+	cbFallback, err := meter.Float64Counter(metrics.Namespace+"client_http_cbfallback_total",
+		metric.WithDescription("Total number of fallback responses served for requests rejected by a circuit-breaker"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("meter.Float64Counter: %w", err)
+	}
+
+	cbState, err := meter.Int64ObservableGauge(metrics.Namespace+"client_http_cbstate",
+		metric.WithDescription("Current state of the circuit-breakers: 0 closed, 1 half-open, 2 open"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("meter.Int64ObservableGauge: %w", err)
+	}
+
+	stats := &Stats{
 		CBOpen:            cbOpen,
 		CBTooManyRequests: cbTooManyRequests,
-	}, nil
+		CBTransitions:     cbTransitions,
+		CBFallback:        cbFallback,
+		CBState:           cbState,
+	}
+	_, err = meter.RegisterCallback(stats.observe, cbState)
+	if err != nil {
+		return nil, fmt.Errorf("meter.RegisterCallback: %w", err)
+	}
+	return stats, nil
+}
+
+// Observe reports the states of the circuit breakers of registry with the CBState gauge, until unregister is called.
+// A registry observed several times with the same module name is reported once, until all of them are unregistered.
+func (s *Stats) Observe(registry *Registry, moduleName string) (unregister func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := observed{registry: registry, moduleName: moduleName}
+	if s.observed == nil {
+		s.observed = make(map[observed]int)
+	}
+	s.observed[o]++
+	return sync.OnceFunc(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.observed[o]--
+		if s.observed[o] == 0 {
+			delete(s.observed, o)
+		}
+	})
+}
+
+func (s *Stats) observe(_ context.Context, observer metric.Observer) error {
+	s.mu.Lock()
+	registries := make([]observed, 0, len(s.observed))
+	for o := range s.observed {
+		registries = append(registries, o)
+	}
+	s.mu.Unlock()
+
+	for _, o := range registries {
+		for _, b := range o.registry.list() {
+			observer.ObserveInt64(s.CBState, int64(b.cb.State()), metric.WithAttributes(
+				attribute.String(metrics.PKGLabelName, o.moduleName),
+				attribute.String(metrics.NameLabelName, b.cb.Name()),
+			))
+		}
+	}
+	return nil
 }
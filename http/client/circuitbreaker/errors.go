@@ -1,6 +1,23 @@
 package circuitbreaker
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var ErrHTTP = errors.New("circuit breaker unexpected HTTP error")
 var ErrUnexpectedHTTPStatus = errors.New("unexpected HTTP status")
+var ErrUnknownBreaker = errors.New("unknown circuit breaker")
+
+// StatusError reports the status code of an error response to the circuit breaker classifier.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status code %v: %v", e.StatusCode, ErrUnexpectedHTTPStatus)
+}
+
+func (e *StatusError) Unwrap() error {
+	return ErrUnexpectedHTTPStatus
+}
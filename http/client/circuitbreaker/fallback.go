@@ -0,0 +1,32 @@
+package circuitbreaker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// FallbackHeader is set to "true" on the responses served by a Fallback.
+const FallbackHeader = "X-Circuit-Breaker-Fallback"
+
+// Fallback returns the response served when the circuit breaker rejects r with err,
+// e.g. a stale cached copy. Returning nil keeps the rejection error.
+type Fallback func(r *http.Request, err error) *http.Response
+
+// StaticFallback serves a response with the given status code, header and body.
+func StaticFallback(statusCode int, header http.Header, body []byte) Fallback {
+	return func(r *http.Request, _ error) *http.Response {
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+			StatusCode:    statusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       r,
+		}
+	}
+}
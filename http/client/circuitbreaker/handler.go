@@ -0,0 +1,55 @@
+package circuitbreaker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Actions of the Handler.
+const (
+	ActionForceOpen   = "force-open"
+	ActionForceClosed = "force-closed"
+	ActionReset       = "reset"
+	// ActionUnforce removes the override of a circuit breaker.
+	ActionUnforce = "unforce"
+)
+
+// Handler is an admin handler for the circuit breakers of registry.
+// GET lists the circuit breakers with their state and counts as JSON.
+// POST applies the action form value (force-open, force-closed, unforce, reset) to the circuit breaker
+// given by the name form value.
+func Handler(registry *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			name := r.FormValue("name")
+			var err error
+			switch r.FormValue("action") {
+			case ActionForceOpen:
+				err = registry.Force(name, OverrideOpen)
+			case ActionForceClosed:
+				err = registry.Force(name, OverrideClosed)
+			case ActionUnforce:
+				err = registry.Force(name, OverrideNone)
+			case ActionReset:
+				err = registry.Reset(name)
+			default:
+				http.Error(w, "unknown action", http.StatusBadRequest)
+				return
+			}
+			if errors.Is(err, ErrUnknownBreaker) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(registry.Breakers())
+	})
+}
@@ -0,0 +1,187 @@
+package circuitbreaker
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sony/gobreaker/v2"
+)
+
+// KeyFunc returns the key used to select the circuit breaker of a request.
+type KeyFunc func(r *http.Request) string
+
+// HostKey keys circuit breakers by the host (and port) of the request URL.
+func HostKey(r *http.Request) string {
+	return r.URL.Host
+}
+
+// HostPathPrefixKey keys circuit breakers by the host and the first segments of the request path.
+func HostPathPrefixKey(segments int) KeyFunc {
+	return func(r *http.Request) string {
+		path := r.URL.Path
+		end := 0
+		for i := 0; i < segments && end < len(path); i++ {
+			next := end + 1
+			for next < len(path) && path[next] != '/' {
+				next++
+			}
+			end = next
+		}
+		return r.URL.Host + path[:end]
+	}
+}
+
+// Override forces the state of a circuit breaker, see Registry.Force.
+type Override int32
+
+const (
+	// OverrideNone lets the circuit breaker decide.
+	OverrideNone Override = iota
+	// OverrideOpen rejects all the requests, e.g. during a maintenance.
+	OverrideOpen
+	// OverrideClosed lets all the requests through without counting them.
+	OverrideClosed
+)
+
+// String implements stringer interface.
+func (o Override) String() string {
+	switch o {
+	case OverrideNone:
+		return "none"
+	case OverrideOpen:
+		return "force-open"
+	case OverrideClosed:
+		return "force-closed"
+	default:
+		return fmt.Sprintf("unknown override: %d", o)
+	}
+}
+
+type breaker struct {
+	cb       *gobreaker.CircuitBreaker[*http.Response]
+	settings gobreaker.Settings
+	override atomic.Int32
+	lastUsed time.Time
+}
+
+func newBreaker(settings gobreaker.Settings) *breaker {
+	return &breaker{
+		cb:       gobreaker.NewCircuitBreaker[*http.Response](settings),
+		settings: settings,
+	}
+}
+
+// Breaker describes a circuit breaker of a Registry.
+type Breaker struct {
+	Name     string           `json:"name"`
+	State    string           `json:"state"`
+	Override string           `json:"override"`
+	Counts   gobreaker.Counts `json:"counts"`
+}
+
+// Registry keeps the circuit breakers of a transport, one per key.
+// Breakers are created lazily and evicted once they stay idle in the closed state.
+type Registry struct {
+	mu        sync.Mutex
+	breakers  map[string]*breaker
+	lastSweep time.Time
+}
+
+// NewRegistry creates an empty registry of circuit breakers.
+func NewRegistry() *Registry {
+	return &Registry{
+		breakers: make(map[string]*breaker),
+	}
+}
+
+// get returns the breaker registered under name, creating it with settings if needed.
+// Breakers idle for longer than idleTimeout are evicted, at most once per idleTimeout.
+func (r *Registry) get(name string, settings gobreaker.Settings, idleTimeout time.Duration) *breaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if idleTimeout > 0 && now.Sub(r.lastSweep) >= idleTimeout {
+		r.evict(now, idleTimeout)
+		r.lastSweep = now
+	}
+
+	b, ok := r.breakers[name]
+	if !ok {
+		settings.Name = name
+		b = newBreaker(settings)
+		r.breakers[name] = b
+	}
+	b.lastUsed = now
+	return b
+}
+
+// list returns the breakers of the registry.
+func (r *Registry) list() []*breaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	breakers := make([]*breaker, 0, len(r.breakers))
+	for _, b := range r.breakers {
+		breakers = append(breakers, b)
+	}
+	return breakers
+}
+
+// Breakers describes the circuit breakers of the registry, sorted by name.
+func (r *Registry) Breakers() []Breaker {
+	breakers := make([]Breaker, 0)
+	for _, b := range r.list() {
+		breakers = append(breakers, Breaker{
+			Name:     b.cb.Name(),
+			State:    b.cb.State().String(),
+			Override: Override(b.override.Load()).String(),
+			Counts:   b.cb.Counts(),
+		})
+	}
+	slices.SortFunc(breakers, func(a, b Breaker) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return breakers
+}
+
+// Force overrides the state of the circuit breaker name, OverrideNone removes the override.
+func (r *Registry) Force(name string, override Override) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.breakers[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownBreaker, name)
+	}
+	b.override.Store(int32(override))
+	return nil
+}
+
+// Reset replaces the circuit breaker name by a new closed one, without override.
+func (r *Registry) Reset(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.breakers[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownBreaker, name)
+	}
+	reset := newBreaker(b.settings)
+	reset.lastUsed = b.lastUsed
+	r.breakers[name] = reset
+	return nil
+}
+
+// evict removes the breakers that are closed and have not been used since idleTimeout.
+// Open, half-open and forced breakers are kept so an idle failing upstream is not retried blindly.
+func (r *Registry) evict(now time.Time, idleTimeout time.Duration) {
+	for name, b := range r.breakers {
+		if now.Sub(b.lastUsed) >= idleTimeout && b.cb.State() == gobreaker.StateClosed &&
+			Override(b.override.Load()) == OverrideNone {
+			delete(r.breakers, name)
+		}
+	}
+}
@@ -5,50 +5,173 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/sony/gobreaker/v2"
+	"github.com/treussart/articles/http/client/internal/body"
+	"github.com/treussart/articles/http/client/internal/cleanup"
 	"github.com/treussart/articles/http/client/metrics"
 	"go.opentelemetry.io/otel/attribute"
 	api "go.opentelemetry.io/otel/metric"
 )
 
 // Transport represents an HTTP transport with integrated circuit-breaker and statistics tracking mechanisms.
+// A circuit breaker is kept per key returned by KeyFunc (the request host by default), so a failing
+// upstream does not trip the calls made to the others.
 type Transport struct {
-	Tripper       http.RoundTripper
-	Breaker       *gobreaker.CircuitBreaker[*http.Response]
+	Tripper http.RoundTripper
+	// Settings is used to create every circuit breaker, Name is suffixed by the key.
+	// State transitions are counted in Stats before calling OnStateChange.
+	// IsSuccessful defaults to IsSuccessful(StatusCodeMax), it receives a *StatusError for the 4xx and 5xx responses.
+	// IsExcluded defaults to IsExcluded.
+	Settings gobreaker.Settings
+	KeyFunc  KeyFunc
+	// IdleTimeout is the duration after which an unused closed circuit breaker is evicted, 0 disables eviction.
+	IdleTimeout time.Duration
+	// Registry holds the circuit breakers, a private one is created if nil.
+	Registry *Registry
+	// Breaker, if set while Registry is nil, is the single circuit breaker of all the requests.
+	// Only the responses from StatusCodeMax are failures, Settings, KeyFunc and IdleTimeout are ignored.
+	//
+	// Deprecated: use Settings, with a Registry to share the circuit breakers.
+	Breaker *gobreaker.CircuitBreaker[*http.Response]
+	// Fallback, if set, serves a response when the circuit breaker rejects a request.
+	Fallback      Fallback
 	Stats         *Stats
 	ModuleName    string
 	StatusCodeMax int
+
+	once        sync.Once
+	settings    gobreaker.Settings
+	single      *breaker
+	observation *cleanup.Handle
+}
+
+// onStateChange counts the transitions in stats before calling next. It doesn't reference the transport,
+// so the registry doesn't keep it reachable.
+func onStateChange(stats *Stats, moduleName string, next func(name string, from gobreaker.State, to gobreaker.State),
+) func(name string, from gobreaker.State, to gobreaker.State) {
+	return func(name string, from gobreaker.State, to gobreaker.State) {
+		if stats != nil {
+			stats.CBTransitions.Add(context.Background(), 1, api.WithAttributes(
+				attribute.String(metrics.PKGLabelName, moduleName),
+				attribute.String(metrics.NameLabelName, name),
+				attribute.String(metrics.FromLabelName, from.String()),
+				attribute.String(metrics.ToLabelName, to.String()),
+			))
+		}
+		if next != nil {
+			next(name, from, to)
+		}
+	}
+}
+
+func (t *Transport) breaker(r *http.Request) *breaker {
+	t.once.Do(func() {
+		if t.Registry == nil && t.Breaker != nil {
+			t.single = &breaker{cb: t.Breaker}
+			return
+		}
+		if t.Registry == nil {
+			t.Registry = NewRegistry()
+		}
+		if t.Stats != nil {
+			// The registry is observed until the transport is garbage collected.
+			t.observation = cleanup.New(t.Stats.Observe(t.Registry, t.ModuleName))
+		}
+		t.settings = t.Settings
+		t.settings.OnStateChange = onStateChange(t.Stats, t.ModuleName, t.Settings.OnStateChange)
+		if t.settings.IsSuccessful == nil {
+			t.settings.IsSuccessful = IsSuccessful(t.StatusCodeMax)
+		}
+		if t.settings.IsExcluded == nil {
+			t.settings.IsExcluded = IsExcluded
+		}
+	})
+	if t.single != nil {
+		return t.single
+	}
+	keyFunc := t.KeyFunc
+	if keyFunc == nil {
+		keyFunc = HostKey
+	}
+	key := keyFunc(r)
+	name := t.settings.Name
+	if key != "" {
+		name += " " + key
+	}
+	return t.Registry.get(name, t.settings, t.IdleTimeout)
 }
 
 // RoundTrip executes the HTTP request and returns the response or an error if the circuit breaker or the request fails.
 func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
-	res, err := t.Breaker.Execute(func() (*http.Response, error) {
+	b := t.breaker(r)
+	// Error responses are classified by the IsSuccessful setting, the Breaker only sees the failures.
+	minStatusError := http.StatusBadRequest
+	if b == t.single {
+		minStatusError = t.StatusCodeMax
+	}
+	call := func() (*http.Response, error) {
 		res, err := t.Tripper.RoundTrip(r)
 		if err != nil {
 			return nil, fmt.Errorf("t.tripper.RoundTrip: %w", err)
 		}
 
-		if res != nil && res.StatusCode >= t.StatusCodeMax {
-			return res, fmt.Errorf("status code %v: %w", res.StatusCode, ErrUnexpectedHTTPStatus)
+		if res != nil && res.StatusCode >= minStatusError {
+			return res, &StatusError{StatusCode: res.StatusCode}
 		}
 
 		return res, nil
-	})
+	}
+
+	var res *http.Response
+	var err error
+	switch Override(b.override.Load()) {
+	case OverrideOpen:
+		err = gobreaker.ErrOpenState
+	case OverrideClosed:
+		res, err = call()
+	default:
+		res, err = b.cb.Execute(call)
+	}
+
+	// Only the responses from StatusCodeMax are returned as errors.
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.StatusCode < t.StatusCodeMax {
+			return res, nil
+		}
+		body.Drain(res)
+	}
 
 	if err != nil {
+		attrs := api.WithAttributes(
+			attribute.String(metrics.PKGLabelName, t.ModuleName),
+			attribute.String(metrics.NameLabelName, b.cb.Name()),
+			attribute.String(metrics.HostLabelName, r.URL.Host),
+		)
 		if errors.Is(err, gobreaker.ErrOpenState) {
 			if t.Stats != nil {
-				t.Stats.CBOpen.Add(context.Background(), 1, api.WithAttributes(
-					attribute.String(metrics.PKGLabelName, t.ModuleName),
-				))
+				t.Stats.CBOpen.Add(context.Background(), 1, attrs)
 			}
 		}
 		if errors.Is(err, gobreaker.ErrTooManyRequests) {
 			if t.Stats != nil {
-				t.Stats.CBTooManyRequests.Add(context.Background(), 1, api.WithAttributes(
-					attribute.String(metrics.PKGLabelName, t.ModuleName),
-				))
+				t.Stats.CBTooManyRequests.Add(context.Background(), 1, attrs)
+			}
+		}
+		rejected := errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests)
+		if rejected && t.Fallback != nil {
+			if res := t.Fallback(r, err); res != nil {
+				if res.Header == nil {
+					res.Header = make(http.Header)
+				}
+				res.Header.Set(FallbackHeader, "true")
+				if t.Stats != nil {
+					t.Stats.CBFallback.Add(context.Background(), 1, attrs)
+				}
+				return res, nil
 			}
 		}
 		return nil, fmt.Errorf("t.breaker.Execute: %w: %w", ErrHTTP, err)
@@ -0,0 +1,25 @@
+package circuitbreaker
+
+import (
+	"github.com/sony/gobreaker/v2"
+)
+
+// ConsecutiveFailures trips the circuit breaker after failures consecutive failures.
+func ConsecutiveFailures(failures uint32) func(counts gobreaker.Counts) bool {
+	return func(counts gobreaker.Counts) bool {
+		return counts.ConsecutiveFailures >= failures
+	}
+}
+
+// FailureRatio trips the circuit breaker when at least minRequests requests were made
+// and the ratio of failures reaches ratio (between 0 and 1), excluded requests are not counted.
+// Counts are cleared every interval of the circuit breaker settings, or bucket by bucket with a BucketPeriod.
+func FailureRatio(minRequests uint32, ratio float64) func(counts gobreaker.Counts) bool {
+	return func(counts gobreaker.Counts) bool {
+		requests := counts.Requests - min(counts.TotalExclusions, counts.Requests)
+		if requests == 0 || requests < minRequests {
+			return false
+		}
+		return float64(counts.TotalFailures)/float64(requests) >= ratio
+	}
+}
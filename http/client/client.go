@@ -3,14 +3,17 @@ package client
 import (
 	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
 	"net/http/httptrace"
-	"net/url"
 	"strings"
 	"time"
 
 	"github.com/sony/gobreaker/v2"
+	"github.com/treussart/articles/http/client/bulkhead"
 	"github.com/treussart/articles/http/client/circuitbreaker"
+	"github.com/treussart/articles/http/client/discovery"
+	"github.com/treussart/articles/http/client/hedged"
 	"github.com/treussart/articles/http/client/retryable"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -19,22 +22,28 @@ import (
 const (
 	// We need to consume response bodies to maintain http connections, but
 	// limit the size we consume to respReadLimit.
-	defaultConcurrency      = 100
-	defaultTimeout          = 4 * time.Second
-	defaultRetryMax         = 3
-	defaultRetryWaitMin     = 50 * time.Millisecond
-	defaultRetryWaitMax     = 1 * time.Second
-	defaultKeepAliveTimeout = 15 * time.Second
-	defaultCBTimeout        = 60 * time.Second
+	defaultConcurrency       = 100
+	defaultTimeout           = 4 * time.Second
+	defaultRetryMax          = 3
+	defaultRetryWaitMin      = 50 * time.Millisecond
+	defaultRetryWaitMax      = 1 * time.Second
+	defaultKeepAliveTimeout  = 15 * time.Second
+	defaultCBTimeout         = 60 * time.Second
+	defaultCBIdleTimeout     = 10 * time.Minute
+	defaultTLSReloadInterval = 10 * time.Second
 	// Circuit breaker does not take retries into account
 	defaultCBConsecutiveFailures = 2
 	defaultCBMaxRequests         = 1
 	defaultCBHTTPSatusCodeMax    = http.StatusInternalServerError
 )
 
-func getTransport(config customConfig) http.RoundTripper {
+// newHTTPTransport returns the transport sending the requests, with its connections made by dial.
+// Requests are proxied only if proxy is true.
+func newHTTPTransport(config customConfig, tlsConfig *tls.Config, verify verifyFunc,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error), proxy bool) http.RoundTripper {
 	tr := &http.Transport{
-		TLSClientConfig:   nil,
+		// Cloned since HTTP/2 adds its protocols to it.
+		TLSClientConfig:   tlsConfig.Clone(),
 		ForceAttemptHTTP2: false,
 		// https://tleyden.github.io/blog/2016/11/21/tuning-the-go-http-client-library-for-load-testing/
 		MaxIdleConns:          config.concurrency,
@@ -44,28 +53,79 @@ func getTransport(config customConfig) http.RoundTripper {
 		DisableKeepAlives:     config.disableKeepAlive,
 		IdleConnTimeout:       config.keepAliveTimeout,
 		ExpectContinueTimeout: 1 * time.Second,
+		DialContext:           dial,
 	}
-	if config.dialer != nil {
-		tr.DialContext = config.dialer
+	if verify != nil {
+		tr.DialTLSContext = dialTLS(tr, verify)
 	}
-	if config.insecureSkipVerify {
-		//nolint: gosec
-		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	if proxy {
+		tr.Proxy = getProxy(config)
+		tr.ProxyConnectHeader = config.proxyConnectHeader
 	}
+	return configureHTTP2(tr, config)
+}
 
-	if config.proxyHost != "" {
-		tr.Proxy = http.ProxyURL(&url.URL{Host: config.proxyHost})
-	} else {
-		tr.Proxy = nil
+func getTransport(config customConfig) http.RoundTripper {
+	tlsConfig, verify := getTLSConfig(config)
+
+	// Endpoints are selected per attempt, so a retry can go to another endpoint.
+	// Each endpoint has its own transport, its connections can't be proxied.
+	base := newHTTPTransport(config, tlsConfig, verify, config.dialer, true)
+	if proxy := getProxy(config); verify != nil && proxy != nil {
+		base = &proxiedTLS{
+			Tripper: base,
+			Proxy:   proxy,
+			NewTripper: func(host string) http.RoundTripper {
+				return newHTTPTransport(config, tlsConfigFor(tlsConfig, verify, host), nil, config.dialer, true)
+			},
+		}
+	}
+	if config.discoveryServices != nil {
+		base = &discovery.Transport{
+			Tripper: base,
+			NewTripper: func(addr string) http.RoundTripper {
+				return newHTTPTransport(config, tlsConfig, verify, discovery.DialEndpoint(config.dialer, addr), false)
+			},
+			Resolver:        config.discoveryResolver,
+			Services:        config.discoveryServices,
+			Strategy:        config.discoveryStrategy,
+			RefreshInterval: config.discoveryRefresh,
+			MaxFailures:     config.outlierMaxFailures,
+			EjectionTime:    config.outlierEjectionTime,
+			Stats:           config.discoveryStats,
+			ModuleName:      config.moduleName,
+		}
+	}
+
+	// Each attempt is hedged, the hedged requests withdraw from the retry budget so they don't multiply the calls.
+	// They are sent under the circuit breaker, so they count as a single call.
+	if config.hedgeDelay > 0 || config.hedgePercentile > 0 {
+		base = &hedged.Transport{
+			Tripper:    base,
+			Delay:      config.hedgeDelay,
+			MaxHedges:  config.hedgeMax,
+			Percentile: config.hedgePercentile,
+			Budget:     config.retryBudget,
+			Stats:      config.retryStats,
+			ModuleName: config.moduleName,
+		}
 	}
 
 	retryableTransport := &retryable.Transport{
-		Tripper:      tr,
-		RetryMax:     config.retryMax,
-		RetryWaitMin: config.retryWaitMin,
-		RetryWaitMax: config.retryWaitMax,
-		Stats:        config.retryStats,
-		ModuleName:   config.moduleName,
+		Tripper:                base,
+		RetryMax:               config.retryMax,
+		RetryWaitMin:           config.retryWaitMin,
+		RetryWaitMax:           config.retryWaitMax,
+		RetryPolicy:            config.retryPolicy,
+		Backoff:                config.backoff,
+		Stats:                  config.retryStats,
+		ModuleName:             config.moduleName,
+		GenerateIdempotencyKey: config.idempotencyKey,
+		Budget:                 config.retryBudget,
+		MaxBufferedBody:        config.maxBufferedBody,
+		AttemptTimeout:         config.attemptTimeout,
+		AttemptHeader:          config.attemptHeader,
+		OnRetry:                config.onRetry,
 	}
 
 	otelhttpTransport := otelhttp.NewTransport(retryableTransport,
@@ -75,30 +135,59 @@ func getTransport(config customConfig) http.RoundTripper {
 		otelhttp.WithFilter(OperationalEndpointFilter),
 	)
 
+	var tripper http.RoundTripper = otelhttpTransport
+
 	if config.enableCircuitBreaker {
 		if config.cbConsecutiveFailures == 0 {
 			config.cbConsecutiveFailures = defaultCBConsecutiveFailures
 		}
+		readyToTrip := circuitbreaker.ConsecutiveFailures(config.cbConsecutiveFailures)
+		if config.cbFailureRatio > 0 {
+			readyToTrip = circuitbreaker.FailureRatio(config.cbMinRequests, config.cbFailureRatio)
+		}
+		if config.cbReadyToTrip != nil {
+			readyToTrip = config.cbReadyToTrip
+		}
+		isSuccessful := circuitbreaker.IsSuccessful(config.cbSatusCodeMax, config.cbFailureStatusCodes...)
+		if config.cbIsSuccessful != nil {
+			isSuccessful = config.cbIsSuccessful
+		}
 		cbConf := gobreaker.Settings{
-			Name:        "HTTP Circuit Breaker",
-			Timeout:     config.cbTimeout,
-			MaxRequests: config.cbMaxRequests,
-			ReadyToTrip: func(counts gobreaker.Counts) bool {
-				return counts.ConsecutiveFailures >= config.cbConsecutiveFailures
-			},
+			Name:          "HTTP Circuit Breaker",
+			Timeout:       config.cbTimeout,
+			Interval:      config.cbInterval,
+			BucketPeriod:  config.cbBucketPeriod,
+			MaxRequests:   config.cbMaxRequests,
+			ReadyToTrip:   readyToTrip,
+			OnStateChange: config.cbOnStateChange,
+			IsSuccessful:  isSuccessful,
 		}
 		circuitBreakerTransport := &circuitbreaker.Transport{
-			Tripper: otelhttpTransport,
-			//nolint: bodyclose
-			Breaker:       gobreaker.NewCircuitBreaker[*http.Response](cbConf),
+			Tripper:       tripper,
+			Settings:      cbConf,
+			KeyFunc:       config.cbKeyFunc,
+			IdleTimeout:   config.cbIdleTimeout,
+			Registry:      config.cbRegistry,
+			Fallback:      config.cbFallback,
 			Stats:         config.circuitBreakerStats,
 			ModuleName:    config.moduleName,
 			StatusCodeMax: config.cbSatusCodeMax,
 		}
+		tripper = circuitBreakerTransport
+	}
 
-		return circuitBreakerTransport
+	// The bulkhead is above the circuit breaker, so its rejections are not counted as upstream failures.
+	if config.bulkheadMaxInFlight > 0 {
+		tripper = &bulkhead.Transport{
+			Tripper:      tripper,
+			MaxInFlight:  config.bulkheadMaxInFlight,
+			MaxQueue:     config.bulkheadMaxQueue,
+			QueueTimeout: config.bulkheadQueueTimeout,
+			Stats:        config.bulkheadStats,
+			ModuleName:   config.moduleName,
+		}
 	}
-	return otelhttpTransport
+	return tripper
 }
 
 // OperationalEndpointFilter filters out requests to operational endpoints like "health", and "ready".
@@ -123,6 +212,8 @@ func Client(options ...CustomOption) *http.Client {
 		WithEnableCircuitBreaker(false),
 		WithCBTimeout(defaultCBTimeout),
 		WithCBMaxRequests(defaultCBMaxRequests),
+		WithCBIdleTimeout(defaultCBIdleTimeout),
+		WithTLSReloadInterval(defaultTLSReloadInterval),
 		WithCBHTTPSatusCodeMax(defaultCBHTTPSatusCodeMax),
 	}
 	var config customConfig
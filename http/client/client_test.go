@@ -2,23 +2,52 @@ package client
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/sony/gobreaker/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/treussart/articles/http/client/bulkhead"
 	"github.com/treussart/articles/http/client/circuitbreaker"
 	"github.com/treussart/articles/http/client/dialer"
+	"github.com/treussart/articles/http/client/discovery"
 	"github.com/treussart/articles/http/client/retryable"
+	"github.com/treussart/articles/http/client/tlsconfig"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	stdout "go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func TestClient(t *testing.T) {
@@ -46,7 +75,11 @@ func TestClient(t *testing.T) {
 
 func TestClient_insecure(t *testing.T) {
 	// https server for doh service
-	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/dns-query" {
+			serveDoH(t, w, r)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 	}))
 	defer svr.Close()
@@ -57,6 +90,44 @@ func TestClient_insecure(t *testing.T) {
 	response, err := httpClient.Get(svr.URL)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	// host name resolved by the doh service
+	resolver := &dialer.Resolver{
+		Servers:    []string{svr.URL + "/dns-query"},
+		Protocol:   dialer.ProtocolHTTPS,
+		HTTPClient: svr.Client(),
+	}
+	httpClient = Client(
+		WithInsecureSkipVerify(true),
+		WithDialer(resolver.DialContext),
+	)
+	_, port, err := net.SplitHostPort(svr.Listener.Addr().String())
+	require.NoError(t, err)
+	response, err = httpClient.Get("https://api.test:" + port)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+// serveDoH answers the DNS-over-HTTPS queries with 127.0.0.1 for every A record.
+func serveDoH(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	t.Helper()
+	query, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(query))
+	msg.Response = true
+	for _, q := range msg.Questions {
+		if q.Type == dnsmessage.TypeA {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+			})
+		}
+	}
+	answer, err := msg.Pack()
+	require.NoError(t, err)
+	w.Header().Set("Content-Type", "application/dns-message")
+	_, _ = w.Write(answer)
 }
 
 func initTracer() (*sdktrace.TracerProvider, error) {
@@ -161,6 +232,7 @@ func TestClient_retry(t *testing.T) {
 		WithRetryMax(2),
 		WithRetryWaitMin(defaultRetryWaitMin),
 		WithRetryWaitMax(1*time.Second),
+		WithIdempotencyKey(true),
 	)
 	start := time.Now()
 	response, err := httpClient.Post(svr.URL, "text/html", strings.NewReader("test"))
@@ -234,6 +306,62 @@ func TestClient_dialer(t *testing.T) {
 	assert.Equal(t, http.StatusOK, response.StatusCode)
 }
 
+func TestClient_dialer_options(t *testing.T) {
+	// http server
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.RemoteAddr))
+	}))
+	defer svr.Close()
+
+	httpClient := Client(
+		WithDialer(dialer.GetDialer("", 0,
+			dialer.WithFamily(dialer.FamilyIPv4),
+			dialer.WithConnectTimeout(time.Second),
+			dialer.WithKeepAlive(30*time.Second),
+			dialer.WithLocalAddr(net.ParseIP("127.0.0.2")),
+		)),
+	)
+	response, err := httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	content, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	host, _, err := net.SplitHostPort(string(content))
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.2", host)
+}
+
+func TestClient_unix_socket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	var calls atomic.Int32
+	svr := &httptest.Server{
+		Listener: l,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			if calls.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}), ReadHeaderTimeout: time.Second},
+	}
+	svr.Start()
+	defer svr.Close()
+
+	sockets := &dialer.UnixSockets{Paths: map[string]string{"agent": "unix://" + path}}
+	httpClient := Client(
+		WithDialer(sockets.DialContext),
+		WithEnableCircuitBreaker(true),
+		WithRetryWaitMin(time.Millisecond),
+		WithRetryWaitMax(time.Millisecond),
+	)
+	response, err := httpClient.Get("http://agent/metrics")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
 func TestClient_CB(t *testing.T) {
 	// http server
 	counter := 0
@@ -346,6 +474,7 @@ func TestClient_CB_retry(t *testing.T) {
 		WithRetryWaitMax(1*time.Second),
 		WithEnableCircuitBreaker(true),
 		WithCBConsecutiveFailures(1),
+		WithIdempotencyKey(true),
 		WithCBTimeout(2*time.Second),
 	)
 	response, err := httpClient.Post(svr.URL, "text/html", strings.NewReader("test"))
@@ -403,3 +532,1764 @@ func TestClient_CB_target_error(t *testing.T) {
 	assert.Nil(t, response)
 	assert.ErrorIs(t, err, circuitbreaker.ErrHTTP)
 }
+
+func TestClient_CB_per_host(t *testing.T) {
+	// http servers
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	httpClient := Client(
+		WithRetryMax(0),
+		WithEnableCircuitBreaker(true),
+		WithCBConsecutiveFailures(1),
+		WithCBTimeout(2*time.Second),
+	)
+	response, err := httpClient.Get(failing.URL)
+	assert.Nil(t, response)
+	require.ErrorIs(t, err, circuitbreaker.ErrUnexpectedHTTPStatus)
+
+	response, err = httpClient.Get(failing.URL)
+	assert.Nil(t, response)
+	require.ErrorIs(t, err, gobreaker.ErrOpenState)
+
+	response, err = httpClient.Get(healthy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func TestClient_CB_deprecated_breaker(t *testing.T) {
+	// http servers
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	// The single breaker of all the hosts only counts the responses from StatusCodeMax.
+	httpClient := &http.Client{Transport: &circuitbreaker.Transport{
+		Tripper: http.DefaultTransport,
+		Breaker: gobreaker.NewCircuitBreaker[*http.Response](gobreaker.Settings{
+			Name:    "HTTP Circuit Breaker",
+			Timeout: 2 * time.Second,
+			ReadyToTrip: func(counts gobreaker.Counts) bool {
+				return counts.ConsecutiveFailures >= 1
+			},
+		}),
+		StatusCodeMax: http.StatusInternalServerError,
+	}}
+	response, err := httpClient.Get(failing.URL + "/missing")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	_ = response.Body.Close()
+
+	response, err = httpClient.Get(failing.URL)
+	assert.Nil(t, response)
+	require.ErrorIs(t, err, circuitbreaker.ErrUnexpectedHTTPStatus)
+
+	response, err = httpClient.Get(healthy.URL)
+	assert.Nil(t, response)
+	require.ErrorIs(t, err, gobreaker.ErrOpenState)
+}
+
+func TestClient_CB_key_func(t *testing.T) {
+	// http server
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/failing") {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	httpClient := Client(
+		WithRetryMax(0),
+		WithEnableCircuitBreaker(true),
+		WithCBConsecutiveFailures(1),
+		WithCBKeyFunc(circuitbreaker.HostPathPrefixKey(1)),
+	)
+	_, err := httpClient.Get(svr.URL + "/failing/1")
+	require.ErrorIs(t, err, circuitbreaker.ErrUnexpectedHTTPStatus)
+
+	_, err = httpClient.Get(svr.URL + "/failing/2")
+	require.ErrorIs(t, err, gobreaker.ErrOpenState)
+
+	response, err := httpClient.Get(svr.URL + "/healthy")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func TestClient_retry_deadline(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	// http server
+	counter := 0
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		counter++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer svr.Close()
+
+	retryableStats, err := retryable.GetStats("ServiceName")
+	require.NoError(t, err)
+	httpClient := Client(
+		WithTimeout(1*time.Second),
+		WithRetryMax(3),
+		WithRetryWaitMin(2*time.Second),
+		WithRetryWaitMax(2*time.Second),
+		WithRetryableStats(retryableStats, "test"),
+	)
+	start := time.Now()
+	response, err := httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+	assert.Equal(t, 1, counter)
+	assert.Less(t, time.Since(start), 1*time.Second)
+
+	// giving up is not counted as a retry
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	counts := map[string]float64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if sum, ok := m.Data.(metricdata.Sum[float64]); ok {
+				for _, point := range sum.DataPoints {
+					counts[m.Name] += point.Value
+				}
+			}
+		}
+	}
+	assert.InDelta(t, 0, counts["client_http_retry_total"], 0)
+	assert.InDelta(t, 1, counts["client_http_retry_deadline_exceeded_total"], 0)
+}
+
+func TestClient_retry_canceled(t *testing.T) {
+	// http server
+	counter := 0
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		counter++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer svr.Close()
+
+	httpClient := Client(
+		WithRetryMax(3),
+		WithRetryWaitMin(1*time.Second),
+		WithRetryWaitMax(1*time.Second),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, svr.URL, nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	response, err := httpClient.Do(req)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, response)
+	assert.Equal(t, 1, counter)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestClient_retry_policy(t *testing.T) {
+	// http server
+	counter := 0
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		if r.URL.Path == "/bad-gateway" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if counter < 3 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	httpClient := Client(
+		WithRetryMax(3),
+		WithRetryWaitMin(10*time.Millisecond),
+		WithRetryPolicy(retryable.NewRetryPolicy(
+			retryable.RetryOnStatusCodes(http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests),
+			retryable.RetryOnErrors(retryable.TimeoutErrors, retryable.ConnectionErrors),
+		)),
+		WithBackoff(retryable.ConstantBackoff),
+	)
+	response, err := httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, 3, counter)
+
+	counter = 0
+	response, err = httpClient.Get(svr.URL + "/bad-gateway")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+	assert.Equal(t, 1, counter)
+}
+
+func TestClient_retry_unsafe_method(t *testing.T) {
+	// http server
+	counter := 0
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		counter++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer svr.Close()
+
+	httpClient := Client(
+		WithRetryMax(2),
+		WithRetryWaitMin(10*time.Millisecond),
+	)
+	response, err := httpClient.Post(svr.URL, "text/html", strings.NewReader("test"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+	assert.Equal(t, 1, counter)
+
+	counter = 0
+	req, err := http.NewRequest(http.MethodPatch, svr.URL, strings.NewReader("test"))
+	require.NoError(t, err)
+	req.Header.Set(retryable.IdempotencyKeyHeader, "key")
+	response, err = httpClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+	assert.Equal(t, 3, counter)
+}
+
+func TestClient_retry_idempotency_key(t *testing.T) {
+	// http server
+	var keys []string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(retryable.IdempotencyKeyHeader))
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer svr.Close()
+
+	httpClient := Client(
+		WithRetryMax(2),
+		WithRetryWaitMin(10*time.Millisecond),
+		WithIdempotencyKey(true),
+	)
+	_, err := httpClient.Post(svr.URL, "text/html", strings.NewReader("test"))
+	require.NoError(t, err)
+	require.Len(t, keys, 3)
+	assert.NotEmpty(t, keys[0])
+	assert.Equal(t, keys[0], keys[1])
+	assert.Equal(t, keys[0], keys[2])
+
+	_, err = httpClient.Post(svr.URL, "text/html", strings.NewReader("test"))
+	require.NoError(t, err)
+	require.Len(t, keys, 6)
+	assert.NotEqual(t, keys[0], keys[3])
+}
+
+func TestClient_retry_budget(t *testing.T) {
+	// http server
+	counter := 0
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		counter++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer svr.Close()
+
+	retryableStats, err := retryable.GetStats("ServiceName")
+	require.NoError(t, err)
+
+	httpClient := Client(
+		WithRetryMax(3),
+		WithRetryWaitMin(time.Millisecond),
+		WithRetryableStats(retryableStats, "test"),
+		// no retry earned, only the initial balance of 10 retries
+		WithRetryBudget(0, 0),
+	)
+	for range 4 {
+		response, err := httpClient.Get(svr.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+	}
+	assert.Equal(t, 4+10, counter)
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("broken reader")
+}
+
+func TestClient_retry_body(t *testing.T) {
+	// http server
+	var bodies []string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer svr.Close()
+
+	httpClient := Client(
+		WithRetryMax(2),
+		WithRetryWaitMin(time.Millisecond),
+		WithMaxBufferedBody(8),
+	)
+
+	// rewound with GetBody
+	req, err := http.NewRequest(http.MethodPut, svr.URL, strings.NewReader("test"))
+	require.NoError(t, err)
+	_, err = httpClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test", "test", "test"}, bodies)
+
+	// buffered
+	bodies = nil
+	req, err = http.NewRequest(http.MethodPut, svr.URL, io.MultiReader(strings.NewReader("test")))
+	require.NoError(t, err)
+	require.Nil(t, req.GetBody)
+	_, err = httpClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test", "test", "test"}, bodies)
+
+	// larger than the limit, sent once
+	bodies = nil
+	req, err = http.NewRequest(http.MethodPut, svr.URL, io.MultiReader(strings.NewReader("too large body")))
+	require.NoError(t, err)
+	response, err := httpClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+	assert.Equal(t, []string{"too large body"}, bodies)
+
+	// broken reader
+	bodies = nil
+	req, err = http.NewRequest(http.MethodPut, svr.URL, errReader{})
+	require.NoError(t, err)
+	response, err = httpClient.Do(req)
+	require.ErrorContains(t, err, "broken reader")
+	assert.Nil(t, response)
+	assert.Empty(t, bodies)
+}
+
+func TestClient_hedging(t *testing.T) {
+	// http server
+	var counter atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if counter.Add(1) == 1 {
+			// the first request is slow
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	httpClient := Client(
+		WithHedging(50*time.Millisecond, 2),
+		WithEnableCircuitBreaker(true),
+		WithCBConsecutiveFailures(1),
+	)
+	start := time.Now()
+	response, err := httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Less(t, time.Since(start), 1*time.Second)
+	assert.Equal(t, int32(2), counter.Load())
+	_, _ = io.Copy(io.Discard, response.Body)
+	require.NoError(t, response.Body.Close())
+
+	// the cancelled request is not a circuit breaker failure
+	response, err = httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, int32(3), counter.Load())
+
+	// unsafe requests are not hedged
+	counter.Store(0)
+	start = time.Now()
+	response, err = httpClient.Post(svr.URL, "text/html", strings.NewReader("test"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.GreaterOrEqual(t, time.Since(start), 1*time.Second)
+	assert.Equal(t, int32(1), counter.Load())
+}
+
+func TestClient_hedging_limits(t *testing.T) {
+	// http server
+	var counter atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		counter.Add(1)
+		time.Sleep(30 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+	get := func(httpClient *http.Client) {
+		response, err := httpClient.Get(svr.URL)
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, response.Body)
+		require.NoError(t, response.Body.Close())
+	}
+
+	// no hedging until the percentile is known
+	httpClient := Client(WithHedgingPercentile(0.95))
+	for range 5 {
+		get(httpClient)
+	}
+	assert.Equal(t, int32(5), counter.Load())
+
+	// the hedged requests withdraw from the retry budget, 10 retries
+	counter.Store(0)
+	httpClient = Client(
+		WithHedging(5*time.Millisecond, 1),
+		WithRetryBudget(0, 0),
+	)
+	for range 12 {
+		get(httpClient)
+	}
+	require.Eventually(t, func() bool {
+		return counter.Load() == 22
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestClient_attempt_timeout(t *testing.T) {
+	// http server
+	var counter atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if counter.Add(1) == 1 {
+			// the first attempt hangs
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	httpClient := Client(
+		WithTimeout(1*time.Second),
+		WithAttemptTimeout(200*time.Millisecond),
+		WithRetryMax(2),
+		WithRetryWaitMin(10*time.Millisecond),
+	)
+	start := time.Now()
+	response, err := httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, int32(2), counter.Load())
+	assert.Less(t, time.Since(start), 1*time.Second)
+	_, err = io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+}
+
+func TestClient_attempt_timeout_deadline(t *testing.T) {
+	// http server
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	httpClient := Client(
+		WithTimeout(500*time.Millisecond),
+		WithAttemptTimeout(200*time.Millisecond),
+		WithRetryMax(10),
+		WithRetryWaitMin(10*time.Millisecond),
+	)
+	start := time.Now()
+	response, err := httpClient.Get(svr.URL)
+	require.Error(t, err)
+	assert.Nil(t, response)
+	assert.Less(t, time.Since(start), 1*time.Second)
+}
+
+func TestClient_retry_observability(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(tp)
+	defer func() {
+		_ = tp.Shutdown(context.Background())
+	}()
+
+	// http server
+	var attempts []string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts = append(attempts, r.Header.Get(retryable.AttemptHeader))
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer svr.Close()
+
+	var retries []int
+	httpClient := Client(
+		WithRetryMax(2),
+		WithRetryWaitMin(10*time.Millisecond),
+		WithAttemptHeader(true),
+		WithOnRetry(func(attempt int, _ *http.Request, resp *http.Response, err error, wait time.Duration) {
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+			assert.Positive(t, wait)
+			retries = append(retries, attempt)
+		}),
+	)
+	response, err := httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+	assert.Equal(t, []string{"0", "1", "2"}, attempts)
+	assert.Equal(t, []int{1, 2}, retries)
+
+	var attemptSpans int
+	for _, span := range recorder.Ended() {
+		if span.Name() == "HTTP attempt" {
+			attemptSpans++
+		}
+	}
+	assert.Equal(t, 3, attemptSpans)
+}
+
+func TestClient_CB_failure_ratio(t *testing.T) {
+	// http server failing one call out of two
+	counter := 0
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		counter++
+		if counter%2 == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	httpClient := Client(
+		WithRetryMax(0),
+		WithEnableCircuitBreaker(true),
+		WithCBFailureRatio(4, 0.4),
+		WithCBInterval(time.Minute),
+	)
+	// the ratio is checked on failures, the fifth call trips with 3 failures out of 5
+	for range 5 {
+		_, _ = httpClient.Get(svr.URL)
+	}
+	assert.Equal(t, 5, counter)
+
+	response, err := httpClient.Get(svr.URL)
+	assert.Nil(t, response)
+	require.ErrorIs(t, err, gobreaker.ErrOpenState)
+	assert.Equal(t, 5, counter)
+}
+
+func TestClient_CB_bucket_period(t *testing.T) {
+	// http server
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/failing" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	newClient := func(options ...CustomOption) *http.Client {
+		return Client(append([]CustomOption{
+			WithRetryMax(0),
+			WithEnableCircuitBreaker(true),
+			WithCBFailureRatio(5, 0.5),
+			WithCBInterval(800 * time.Millisecond),
+		}, options...)...)
+	}
+	fixed := newClient()
+	rolling := newClient(WithCBBucketPeriod(200 * time.Millisecond))
+	send := func(paths ...string) {
+		for _, path := range paths {
+			for _, httpClient := range []*http.Client{fixed, rolling} {
+				response, err := httpClient.Get(svr.URL + path)
+				if err == nil {
+					_ = response.Body.Close()
+				}
+			}
+		}
+	}
+
+	// the first success slides out of the window, the failures of the previous buckets are kept
+	start := time.Now()
+	send("/")
+	time.Sleep(500*time.Millisecond - time.Since(start))
+	send("/failing", "/failing", "/")
+	time.Sleep(900*time.Millisecond - time.Since(start))
+	send("/failing", "/failing")
+
+	_, err := rolling.Get(svr.URL)
+	require.ErrorIs(t, err, gobreaker.ErrOpenState)
+	// all the counts were cleared at the end of the interval
+	response, err := fixed.Get(svr.URL)
+	require.NoError(t, err)
+	_ = response.Body.Close()
+}
+
+func TestClient_CB_ready_to_trip(t *testing.T) {
+	// http server
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer svr.Close()
+
+	httpClient := Client(
+		WithRetryMax(0),
+		WithEnableCircuitBreaker(true),
+		WithCBReadyToTrip(func(counts gobreaker.Counts) bool {
+			return counts.TotalFailures >= 3
+		}),
+	)
+	for range 3 {
+		_, err := httpClient.Get(svr.URL)
+		require.ErrorIs(t, err, circuitbreaker.ErrUnexpectedHTTPStatus)
+	}
+	_, err := httpClient.Get(svr.URL)
+	require.ErrorIs(t, err, gobreaker.ErrOpenState)
+}
+
+func TestClient_CB_state_change(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	// http server
+	fail := true
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	circuitbreakerStats, err := circuitbreaker.GetStats("ServiceName")
+	require.NoError(t, err)
+
+	var transitions []string
+	httpClient := Client(
+		WithRetryMax(0),
+		WithCircuitBreakerStats(circuitbreakerStats, "test"),
+		WithEnableCircuitBreaker(true),
+		WithCBConsecutiveFailures(1),
+		WithCBTimeout(100*time.Millisecond),
+		WithCBOnStateChange(func(_ string, from gobreaker.State, to gobreaker.State) {
+			transitions = append(transitions, from.String()+"->"+to.String())
+		}),
+	)
+	_, err = httpClient.Get(svr.URL)
+	require.ErrorIs(t, err, circuitbreaker.ErrUnexpectedHTTPStatus)
+	assert.Equal(t, []string{"closed->open"}, transitions)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	states := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "client_http_cbstate" {
+				continue
+			}
+			for _, point := range m.Data.(metricdata.Gauge[int64]).DataPoints {
+				name, _ := point.Attributes.Value(attribute.Key("name"))
+				states[name.AsString()] = point.Value
+			}
+		}
+	}
+	assert.Equal(t, int64(gobreaker.StateOpen), states["HTTP Circuit Breaker "+strings.TrimPrefix(svr.URL, "http://")])
+
+	time.Sleep(150 * time.Millisecond)
+	fail = false
+	response, err := httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, []string{"closed->open", "open->half-open", "half-open->closed"}, transitions)
+}
+
+func TestClient_CB_fallback(t *testing.T) {
+	// http server
+	counter := 0
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		counter++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer svr.Close()
+
+	circuitbreakerStats, err := circuitbreaker.GetStats("ServiceName")
+	require.NoError(t, err)
+
+	httpClient := Client(
+		WithRetryMax(0),
+		WithCircuitBreakerStats(circuitbreakerStats, "test"),
+		WithEnableCircuitBreaker(true),
+		WithCBConsecutiveFailures(1),
+		WithCBFallback(circuitbreaker.StaticFallback(http.StatusOK, http.Header{"Content-Type": {"text/plain"}}, []byte("default"))),
+	)
+	response, err := httpClient.Get(svr.URL)
+	assert.Nil(t, response)
+	require.ErrorIs(t, err, circuitbreaker.ErrUnexpectedHTTPStatus)
+
+	response, err = httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	assert.Equal(t, 1, counter)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "true", response.Header.Get(circuitbreaker.FallbackHeader))
+	assert.Equal(t, "text/plain", response.Header.Get("Content-Type"))
+	content, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "default", string(content))
+}
+
+func TestClient_CB_classifier(t *testing.T) {
+	// http server
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/not-found":
+			w.WriteHeader(http.StatusNotFound)
+		case "/too-many-requests":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer svr.Close()
+
+	httpClient := Client(
+		WithRetryMax(0),
+		WithEnableCircuitBreaker(true),
+		WithCBConsecutiveFailures(1),
+		WithCBFailureStatusCodes(http.StatusTooManyRequests),
+	)
+
+	// client errors are not failures
+	for range 2 {
+		response, err := httpClient.Get(svr.URL + "/not-found")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	}
+
+	// cancellations are not failures
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, svr.URL+"/slow", nil)
+	require.NoError(t, err)
+	_, err = httpClient.Do(req)
+	require.ErrorIs(t, err, context.Canceled)
+
+	response, err := httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	// declared failures trip the circuit breaker
+	response, err = httpClient.Get(svr.URL + "/too-many-requests")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+
+	_, err = httpClient.Get(svr.URL)
+	require.ErrorIs(t, err, gobreaker.ErrOpenState)
+}
+
+func TestClient_CB_half_open_canceled(t *testing.T) {
+	// http server
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer svr.Close()
+
+	var mu sync.Mutex
+	var transitions []string
+	httpClient := Client(
+		WithRetryMax(0),
+		WithEnableCircuitBreaker(true),
+		WithCBConsecutiveFailures(1),
+		WithCBTimeout(50*time.Millisecond),
+		WithCBOnStateChange(func(_ string, from gobreaker.State, to gobreaker.State) {
+			mu.Lock()
+			defer mu.Unlock()
+			transitions = append(transitions, from.String()+"->"+to.String())
+		}),
+	)
+
+	_, err := httpClient.Get(svr.URL)
+	require.Error(t, err)
+	time.Sleep(60 * time.Millisecond)
+
+	// the cancelled probe neither closes the circuit breaker nor uses the half-open request
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, svr.URL+"/slow", nil)
+	require.NoError(t, err)
+	_, err = httpClient.Do(req)
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = httpClient.Get(svr.URL)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, gobreaker.ErrTooManyRequests)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"closed->open", "open->half-open", "half-open->open"}, transitions)
+}
+
+func TestClient_CB_admin_handler(t *testing.T) {
+	// http server
+	fail := false
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	registry := circuitbreaker.NewRegistry()
+	admin := httptest.NewServer(circuitbreaker.Handler(registry))
+	defer admin.Close()
+
+	httpClient := Client(
+		WithRetryMax(0),
+		WithEnableCircuitBreaker(true),
+		WithCBConsecutiveFailures(1),
+		WithCBRegistry(registry),
+	)
+	_, err := httpClient.Get(svr.URL)
+	require.NoError(t, err)
+
+	list := func(response *http.Response, err error) []circuitbreaker.Breaker {
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Equal(t, http.StatusOK, response.StatusCode)
+		var breakers []circuitbreaker.Breaker
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&breakers))
+		return breakers
+	}
+	name := "HTTP Circuit Breaker " + strings.TrimPrefix(svr.URL, "http://")
+	breakers := list(http.Get(admin.URL))
+	require.Len(t, breakers, 1)
+	assert.Equal(t, name, breakers[0].Name)
+	assert.Equal(t, "closed", breakers[0].State)
+	assert.Equal(t, uint32(1), breakers[0].Counts.TotalSuccesses)
+
+	// force open
+	breakers = list(http.PostForm(admin.URL, url.Values{"name": {name}, "action": {circuitbreaker.ActionForceOpen}}))
+	assert.Equal(t, "force-open", breakers[0].Override)
+	_, err = httpClient.Get(svr.URL)
+	require.ErrorIs(t, err, gobreaker.ErrOpenState)
+
+	// force closed, failures are not counted
+	list(http.PostForm(admin.URL, url.Values{"name": {name}, "action": {circuitbreaker.ActionForceClosed}}))
+	fail = true
+	for range 2 {
+		_, err = httpClient.Get(svr.URL)
+		require.ErrorIs(t, err, circuitbreaker.ErrUnexpectedHTTPStatus)
+	}
+
+	// trip then reset
+	list(http.PostForm(admin.URL, url.Values{"name": {name}, "action": {circuitbreaker.ActionUnforce}}))
+	_, err = httpClient.Get(svr.URL)
+	require.ErrorIs(t, err, circuitbreaker.ErrUnexpectedHTTPStatus)
+	breakers = list(http.Get(admin.URL))
+	assert.Equal(t, "open", breakers[0].State)
+
+	breakers = list(http.PostForm(admin.URL, url.Values{"name": {name}, "action": {circuitbreaker.ActionReset}}))
+	assert.Equal(t, "closed", breakers[0].State)
+	assert.Equal(t, "none", breakers[0].Override)
+	fail = false
+	_, err = httpClient.Get(svr.URL)
+	require.NoError(t, err)
+
+	response, err := http.PostForm(admin.URL, url.Values{"name": {"unknown"}, "action": {circuitbreaker.ActionReset}})
+	require.NoError(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns a PEM certificate and key signed by the CA, for 127.0.0.1 and api.internal.
+func (ca *testCA) issue(t *testing.T, commonName string) ([]byte, []byte) {
+	t.Helper()
+	return ca.issueFor(t, commonName, []net.IP{net.ParseIP("127.0.0.1")}, []string{"api.internal"})
+}
+
+// issueFor returns a PEM certificate and key signed by the CA, for ips and dnsNames.
+func (ca *testCA) issueFor(t *testing.T, commonName string, ips []net.IP, dnsNames []string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  ips,
+		DNSNames:     dnsNames,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// newMTLSServer starts a server requiring a client certificate signed by ca, it answers the client common name.
+func newMTLSServer(t *testing.T, ca *testCA) *httptest.Server {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, "server")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	svr.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}
+	svr.StartTLS()
+	return svr
+}
+
+func TestClient_mTLS(t *testing.T) {
+	ca := newTestCA(t)
+	svr := newMTLSServer(t, ca)
+	defer svr.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	writeKeyPair := func(commonName string, modTime time.Time) {
+		certPEM, keyPEM := ca.issue(t, commonName)
+		require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+		require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+		require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+		require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	}
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0o600))
+	writeKeyPair("client-1", time.Now())
+
+	httpClient := Client(
+		WithCAFile(caFile),
+		WithClientCertificate(certFile, keyFile),
+		WithTLSReloadInterval(0),
+		WithMinTLSVersion(tls.VersionTLS12),
+		WithDisableKeepAlive(true),
+	)
+	get := func() string {
+		response, err := httpClient.Get(svr.URL)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		content, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		return string(content)
+	}
+	assert.Equal(t, "client-1", get())
+
+	// certificates rotation
+	writeKeyPair("client-2", time.Now().Add(time.Minute))
+	assert.Equal(t, "client-2", get())
+
+	// SNI override
+	certPEM, keyPEM := ca.issue(t, "client-3")
+	httpClient = Client(
+		WithCAPEM(ca.pem),
+		WithClientCertificatePEM(certPEM, keyPEM),
+		WithServerName("api.internal"),
+	)
+	response, err := httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	httpClient = Client(
+		WithCAPEM(ca.pem),
+		WithClientCertificatePEM(certPEM, keyPEM),
+		WithServerName("other.internal"),
+	)
+	_, err = httpClient.Get(svr.URL)
+	var certErr *tls.CertificateVerificationError
+	require.ErrorAs(t, err, &certErr)
+
+	// unknown CA
+	httpClient = Client(
+		WithClientCertificatePEM(certPEM, keyPEM),
+	)
+	_, err = httpClient.Get(svr.URL)
+	require.ErrorAs(t, err, &certErr)
+}
+
+func TestClient_pinning(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "server")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	svr.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	svr.StartTLS()
+	defer svr.Close()
+
+	// pin of the CA key, with the HPKP prefix
+	httpClient := Client(
+		WithCAPEM(ca.pem),
+		WithPinnedPublicKeys("127.0.0.1", "sha256/"+tlsconfig.SPKIHash(ca.cert)),
+	)
+	response, err := httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	// pin mismatch is not retried
+	tlsStats, err := tlsconfig.GetStats("ServiceName")
+	require.NoError(t, err)
+	var retries int
+	httpClient = Client(
+		WithCAPEM(ca.pem),
+		WithPinnedPublicKeys("127.0.0.1", "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="),
+		WithTLSStats(tlsStats, "test"),
+		WithRetryMax(3),
+		WithRetryWaitMin(time.Millisecond),
+		WithRetryWaitMax(time.Millisecond),
+		WithOnRetry(func(int, *http.Request, *http.Response, error, time.Duration) {
+			retries++
+		}),
+	)
+	_, err = httpClient.Get(svr.URL)
+	require.ErrorIs(t, err, tlsconfig.ErrPinMismatch)
+	assert.Equal(t, 0, retries)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	var failures float64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "client_http_pin_failure_total" {
+				continue
+			}
+			for _, point := range m.Data.(metricdata.Sum[float64]).DataPoints {
+				failures += point.Value
+			}
+		}
+	}
+	assert.InDelta(t, 1, failures, 0)
+
+	// pins are keyed by the dialed host, not the server name
+	httpClient = Client(
+		WithCAPEM(ca.pem),
+		WithServerName("api.internal"),
+		WithPinnedPublicKeys("127.0.0.1", "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="),
+	)
+	_, err = httpClient.Get(svr.URL)
+	require.ErrorIs(t, err, tlsconfig.ErrPinMismatch)
+
+	// hosts without pins are not checked
+	httpClient = Client(
+		WithCAPEM(ca.pem),
+		WithPinnedPublicKeys("other.internal", "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="),
+	)
+	response, err = httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	_ = response.Body.Close()
+
+	// without verification, only the leaf is matched: the server can send any certificate after it
+	cert.Certificate = append(cert.Certificate, ca.cert.Raw)
+	svr.TLS.Certificates = []tls.Certificate{cert}
+	httpClient = Client(
+		WithInsecureSkipVerify(true),
+		WithPinnedPublicKeys("127.0.0.1", tlsconfig.SPKIHash(ca.cert)),
+	)
+	_, err = httpClient.Get(svr.URL)
+	require.ErrorIs(t, err, tlsconfig.ErrPinMismatch)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	httpClient = Client(
+		WithInsecureSkipVerify(true),
+		WithPinnedPublicKeys("127.0.0.1", tlsconfig.SPKIHash(leaf)),
+	)
+	response, err = httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	_ = response.Body.Close()
+}
+
+func TestClient_verify_host(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issueFor(t, "server", []net.IP{net.ParseIP("10.9.9.9")}, []string{"other.example"})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	svr.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	svr.StartTLS()
+	defer svr.Close()
+
+	// certificate of the CA for another IP address
+	httpClient := Client(WithCAPEM(ca.pem), WithRetryMax(0))
+	_, err = httpClient.Get(svr.URL)
+	var certErr *tls.CertificateVerificationError
+	require.ErrorAs(t, err, &certErr)
+	require.ErrorContains(t, err, "not 127.0.0.1")
+
+	// certificate of the CA for another host name
+	_, port, err := net.SplitHostPort(svr.Listener.Addr().String())
+	require.NoError(t, err)
+	httpClient = Client(
+		WithCAPEM(ca.pem),
+		WithRetryMax(0),
+		WithDialer(func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, svr.Listener.Addr().String())
+		}),
+	)
+	_, err = httpClient.Get("https://api.internal:" + port)
+	require.ErrorAs(t, err, &certErr)
+
+	// the server name overrides the dialed host
+	httpClient = Client(WithCAPEM(ca.pem), WithServerName("other.example"))
+	response, err := httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	_ = response.Body.Close()
+	httpClient = Client(WithCAPEM(ca.pem), WithServerName("api.internal"), WithRetryMax(0))
+	_, err = httpClient.Get(svr.URL)
+	require.ErrorAs(t, err, &certErr)
+	require.ErrorContains(t, err, "not api.internal")
+
+	// and through a proxy
+	proxy, _ := newTestProxy(t)
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	httpClient = Client(WithProxy(proxyURL), WithCAPEM(ca.pem), WithServerName("other.example"))
+	response, err = httpClient.Get(svr.URL)
+	require.NoError(t, err)
+	_ = response.Body.Close()
+	httpClient = Client(WithProxy(proxyURL), WithCAPEM(ca.pem), WithServerName("api.internal"), WithRetryMax(0))
+	_, err = httpClient.Get(svr.URL)
+	require.ErrorAs(t, err, &certErr)
+	httpClient = Client(WithProxy(proxyURL), WithCAPEM(ca.pem), WithRetryMax(0))
+	_, err = httpClient.Get(svr.URL)
+	require.ErrorAs(t, err, &certErr)
+	require.ErrorContains(t, err, "not 127.0.0.1")
+}
+
+// newTestProxy starts a forward proxy answering plain requests itself and tunneling CONNECT requests,
+// it records the proxied hosts and proxy headers.
+func newTestProxy(t *testing.T) (*httptest.Server, chan *http.Request) {
+	t.Helper()
+	requests := make(chan *http.Request, 10)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		if r.Method != http.MethodConnect {
+			_, _ = w.Write([]byte("proxied " + r.Host))
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			_ = upstream.Close()
+			return
+		}
+		go func() {
+			_, _ = io.Copy(upstream, conn)
+			_ = upstream.Close()
+		}()
+		_, _ = io.Copy(conn, upstream)
+		_ = conn.Close()
+	}))
+	return svr, requests
+}
+
+func TestClient_proxy(t *testing.T) {
+	proxy, requests := newTestProxy(t)
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	proxyURL.User = url.UserPassword("user", "secret")
+
+	get := func(httpClient *http.Client, u string) string {
+		response, err := httpClient.Get(u)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		content, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	// plain HTTP, with proxy authentication
+	httpClient := Client(WithProxy(proxyURL))
+	assert.Equal(t, "proxied api.test", get(httpClient, "http://api.test/"))
+	r := <-requests
+	user, password, ok := (&http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}).BasicAuth()
+	require.True(t, ok)
+	assert.Equal(t, "user", user)
+	assert.Equal(t, "secret", password)
+
+	// HTTPS through a CONNECT tunnel, with headers
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("direct"))
+	}))
+	defer svr.Close()
+	httpClient = Client(
+		WithProxy(proxyURL),
+		WithProxyConnectHeader(http.Header{"X-Proxy-Token": []string{"token"}}),
+		WithInsecureSkipVerify(true),
+	)
+	assert.Equal(t, "direct", get(httpClient, svr.URL))
+	r = <-requests
+	assert.Equal(t, http.MethodConnect, r.Method)
+	assert.Equal(t, "token", r.Header.Get("X-Proxy-Token"))
+
+	// bypass rules
+	httpClient = Client(
+		WithProxy(proxyURL),
+		WithProxyBypass("*.internal", "10.0.0.0/8", "127.0.0.1"),
+		WithInsecureSkipVerify(true),
+	)
+	assert.Equal(t, "direct", get(httpClient, svr.URL))
+	assert.Equal(t, "proxied api.test", get(httpClient, "http://api.test/"))
+	<-requests
+	bypass := newProxyBypass([]string{"*.internal", ".corp", "10.0.0.0/8", "api.test", "::1"})
+	for host, want := range map[string]bool{
+		"a.internal": true, "b.a.corp": true, "10.1.2.3": true, "API.test": true, "::1": true,
+		"internal": false, "11.0.0.1": false, "api.test2": false,
+	} {
+		assert.Equal(t, want, bypass.match(host), host)
+	}
+
+	// environment
+	t.Setenv("HTTP_PROXY", proxy.URL)
+	t.Setenv("NO_PROXY", "skip.test")
+	httpClient = Client(WithProxyFromEnvironment(true))
+	assert.Equal(t, "proxied api.test", get(httpClient, "http://api.test/"))
+	<-requests
+	_, err = httpClient.Get("http://skip.test/")
+	require.Error(t, err)
+	assert.Empty(t, requests)
+}
+
+func TestClient_pinning_proxy(t *testing.T) {
+	proxy, requests := newTestProxy(t)
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "server")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	svr.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	svr.StartTLS()
+	defer svr.Close()
+	wrongPin := "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	tests := []struct {
+		name    string
+		options []CustomOption
+		wantErr error
+	}{
+		{
+			name:    "IP address",
+			options: []CustomOption{WithCAPEM(ca.pem), WithPinnedPublicKeys("127.0.0.1", wrongPin)},
+			wantErr: tlsconfig.ErrPinMismatch,
+		},
+		{
+			name:    "IP address, without verified chains",
+			options: []CustomOption{WithInsecureSkipVerify(true), WithPinnedPublicKeys("127.0.0.1", wrongPin)},
+			wantErr: tlsconfig.ErrPinMismatch,
+		},
+		{
+			name: "server name",
+			options: []CustomOption{
+				WithCAPEM(ca.pem), WithServerName("api.internal"), WithPinnedPublicKeys("127.0.0.1", wrongPin),
+			},
+			wantErr: tlsconfig.ErrPinMismatch,
+		},
+		{
+			name: "server name, matching pin",
+			options: []CustomOption{
+				WithCAPEM(ca.pem), WithServerName("api.internal"), WithPinnedPublicKeys("127.0.0.1", tlsconfig.SPKIHash(ca.cert)),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpClient := Client(append([]CustomOption{WithProxy(proxyURL), WithRetryMax(0)}, tt.options...)...)
+			response, err := httpClient.Get(svr.URL)
+			// the request is tunneled through the proxy
+			r := <-requests
+			assert.Equal(t, http.MethodConnect, r.Method)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			_ = response.Body.Close()
+			assert.Equal(t, http.StatusOK, response.StatusCode)
+		})
+	}
+}
+
+func TestClient_http2(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write([]byte(r.Proto))
+	})
+	get := func(httpClient *http.Client, u string) string {
+		response, err := httpClient.Get(u)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		content, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	// HTTP/2 over TLS
+	svr := httptest.NewUnstartedServer(handler)
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	assert.Equal(t, "HTTP/1.1", get(Client(WithInsecureSkipVerify(true)), svr.URL))
+	httpClient := Client(
+		WithHTTP2(true),
+		WithHTTP2HealthCheck(time.Second, time.Second),
+		WithInsecureSkipVerify(true),
+		WithConcurrency(2),
+	)
+	assert.Equal(t, "HTTP/2.0", get(httpClient, svr.URL))
+
+	// concurrency limits the streams
+	var wg sync.WaitGroup
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "HTTP/2.0", get(httpClient, svr.URL))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), maxInFlight.Load())
+
+	// the streams are still limited below the bulkhead
+	maxInFlight.Store(0)
+	httpClient = Client(
+		WithHTTP2(true),
+		WithInsecureSkipVerify(true),
+		WithConcurrency(2),
+		WithBulkhead(6),
+	)
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "HTTP/2.0", get(httpClient, svr.URL))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), maxInFlight.Load())
+
+	// h2c
+	h2cSvr := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2cSvr.Close()
+	assert.Equal(t, "HTTP/1.1", get(Client(), h2cSvr.URL))
+	assert.Equal(t, "HTTP/2.0", get(Client(WithH2C(true)), h2cSvr.URL))
+}
+
+// fakeResolver answers the SRV records of its services, and 127.0.0.1 for the other names.
+type fakeResolver struct {
+	mu   sync.Mutex
+	srvs map[string][]*net.SRV
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, name string) ([]*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	srvs, ok := r.srvs[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return srvs, nil
+}
+
+func (r *fakeResolver) LookupIP(context.Context, string, string) ([]net.IP, error) {
+	return []net.IP{net.ParseIP("127.0.0.1")}, nil
+}
+
+func (r *fakeResolver) set(name string, svrs ...*httptest.Server) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var srvs []*net.SRV
+	for _, svr := range svrs {
+		port, _ := strconv.Atoi(svr.URL[strings.LastIndex(svr.URL, ":")+1:])
+		srvs = append(srvs, &net.SRV{Target: "127.0.0.1.", Port: uint16(port), Priority: 10})
+	}
+	r.srvs = map[string][]*net.SRV{name: srvs}
+}
+
+func TestClient_discovery(t *testing.T) {
+	var failing atomic.Bool
+	newEndpoint := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if name == "b" && failing.Load() {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			_, _ = w.Write([]byte(name + " " + r.Host))
+		}))
+	}
+	a, b, c := newEndpoint("a"), newEndpoint("b"), newEndpoint("c")
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+
+	resolver := &fakeResolver{}
+	resolver.set("_http._tcp.api.internal", a, b)
+	discoveryStats, err := discovery.GetStats("ServiceName")
+	require.NoError(t, err)
+	httpClient := Client(
+		WithDiscovery(resolver, map[string]string{"api.internal": "_http._tcp.api.internal"}),
+		WithBalancer(discovery.RoundRobin),
+		WithDiscoveryRefreshInterval(50*time.Millisecond),
+		WithOutlierDetection(1, 100*time.Millisecond),
+		WithDiscoveryStats(discoveryStats, "test"),
+		WithRetryMax(0),
+	)
+	get := func(u string) string {
+		response, err := httpClient.Get(u)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		content, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	// round-robin, with the original Host header
+	assert.Equal(t, "a api.internal", get("http://api.internal/"))
+	assert.Equal(t, "b api.internal", get("http://api.internal/"))
+	assert.Equal(t, "a api.internal", get("http://api.internal/"))
+
+	// outlier ejection then re-admission
+	failing.Store(true)
+	response, err := httpClient.Get("http://api.internal/")
+	require.NoError(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+	for range 3 {
+		assert.Equal(t, "a api.internal", get("http://api.internal/"))
+	}
+	failing.Store(false)
+	time.Sleep(100 * time.Millisecond)
+	assert.ElementsMatch(t, []string{"a api.internal", "b api.internal"},
+		[]string{get("http://api.internal/"), get("http://api.internal/")})
+
+	// refreshed endpoints
+	resolver.set("_http._tcp.api.internal", c)
+	time.Sleep(60 * time.Millisecond)
+	_ = get("http://api.internal/")
+	require.Eventually(t, func() bool {
+		return get("http://api.internal/") == "c api.internal"
+	}, time.Second, 10*time.Millisecond)
+
+	// A records, with the port of the request
+	port := a.URL[strings.LastIndex(a.URL, ":")+1:]
+	httpClient = Client(WithDiscovery(resolver, map[string]string{"multi-a": "multi-a.internal"}))
+	assert.Equal(t, "a multi-a:"+port, get("http://multi-a:"+port+"/"))
+
+	// other hosts
+	assert.Equal(t, "a "+strings.TrimPrefix(a.URL, "http://"), get(a.URL))
+
+	// https endpoints are verified with the host of the service
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issueFor(t, "server", nil, []string{"api.internal"})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	d := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("d " + r.TLS.ServerName))
+	}))
+	d.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	d.StartTLS()
+	defer d.Close()
+	resolver.set("_https._tcp.api.internal", d)
+	httpClient = Client(
+		WithCAPEM(ca.pem),
+		WithDiscovery(resolver, map[string]string{"api.internal": "_https._tcp.api.internal"}),
+	)
+	assert.Equal(t, "d api.internal", get("https://api.internal/"))
+}
+
+func TestClient_discovery_canceled(t *testing.T) {
+	newEndpoint := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				<-r.Context().Done()
+				return
+			}
+			_, _ = w.Write([]byte(name))
+		}))
+	}
+	a, b := newEndpoint("a"), newEndpoint("b")
+	defer a.Close()
+	defer b.Close()
+
+	resolver := &fakeResolver{}
+	resolver.set("_http._tcp.api.internal", a, b)
+	httpClient := Client(
+		WithDiscovery(resolver, map[string]string{"api.internal": "_http._tcp.api.internal"}),
+		WithOutlierDetection(1, time.Minute),
+		WithRetryMax(0),
+	)
+
+	// the cancelled request doesn't eject the endpoint
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://api.internal/slow", nil)
+	require.NoError(t, err)
+	_, err = httpClient.Do(req)
+	require.ErrorIs(t, err, context.Canceled)
+
+	var names []string
+	for range 2 {
+		response, err := httpClient.Get("http://api.internal/")
+		require.NoError(t, err)
+		content, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		_ = response.Body.Close()
+		names = append(names, string(content))
+	}
+	assert.ElementsMatch(t, []string{"a", "b"}, names)
+}
+
+func TestClient_bulkhead(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	// http server
+	received := make(chan struct{}, 10)
+	release := make(chan struct{})
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		received <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	bulkheadStats, err := bulkhead.GetStats("ServiceName")
+	require.NoError(t, err)
+	httpClient := Client(
+		WithBulkhead(1),
+		WithBulkheadQueue(1, 100*time.Millisecond),
+		WithBulkheadStats(bulkheadStats, "test"),
+		WithRetryMax(0),
+	)
+	get := func() error {
+		response, err := httpClient.Get(svr.URL)
+		if err != nil {
+			return err
+		}
+		return response.Body.Close()
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- get() }()
+	<-received
+	go func() { errs <- get() }()
+
+	gauges := func() map[string]int64 {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, reader.Collect(context.Background(), &rm))
+		values := map[string]int64{}
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if gauge, ok := m.Data.(metricdata.Gauge[int64]); ok {
+					for _, point := range gauge.DataPoints {
+						values[m.Name] += point.Value
+					}
+				}
+			}
+		}
+		return values
+	}
+	require.Eventually(t, func() bool {
+		return gauges()["client_http_bulkhead_queued"] == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(1), gauges()["client_http_bulkhead_inflight"])
+
+	// queue full
+	require.ErrorIs(t, get(), bulkhead.ErrBulkheadFull)
+	// queue timeout
+	require.ErrorIs(t, <-errs, bulkhead.ErrBulkheadFull)
+
+	close(release)
+	require.NoError(t, <-errs)
+	require.NoError(t, get())
+	assert.Equal(t, map[string]int64{"client_http_bulkhead_inflight": 0, "client_http_bulkhead_queued": 0}, gauges())
+}
+
+func TestClient_bulkhead_nil_body(t *testing.T) {
+	// http server
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer svr.Close()
+
+	httpClient := Client(
+		WithBulkhead(1),
+		WithRetryMax(0),
+		WithEnableCircuitBreaker(true),
+		WithCBConsecutiveFailures(1),
+		WithCBFallback(func(*http.Request, error) *http.Response {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable}
+		}),
+	)
+	_, err := httpClient.Get(svr.URL)
+	require.ErrorIs(t, err, circuitbreaker.ErrUnexpectedHTTPStatus)
+
+	// the slot of a fallback without body is released
+	for range 2 {
+		response, err := httpClient.Get(svr.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+		require.NoError(t, response.Body.Close())
+	}
+}
+
+func TestClient_stats_garbage_collected(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	// http server
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	circuitbreakerStats, err := circuitbreaker.GetStats("ServiceName")
+	require.NoError(t, err)
+	bulkheadStats, err := bulkhead.GetStats("ServiceName")
+	require.NoError(t, err)
+
+	// gauges returns the names of the gauges reported for the module name.
+	gauges := func(moduleName string) []string {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, reader.Collect(context.Background(), &rm))
+		var names []string
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if gauge, ok := m.Data.(metricdata.Gauge[int64]); ok {
+					for _, point := range gauge.DataPoints {
+						if pkg, _ := point.Attributes.Value(attribute.Key("pkg")); pkg.AsString() == moduleName {
+							names = append(names, m.Name)
+						}
+					}
+				}
+			}
+		}
+		return names
+	}
+	get := func(moduleName string) *http.Client {
+		httpClient := Client(
+			WithRetryMax(0),
+			WithEnableCircuitBreaker(true),
+			WithCircuitBreakerStats(circuitbreakerStats, moduleName),
+			WithBulkhead(1),
+			WithBulkheadStats(bulkheadStats, moduleName),
+		)
+		response, err := httpClient.Get(svr.URL)
+		require.NoError(t, err)
+		require.NoError(t, response.Body.Close())
+		return httpClient
+	}
+
+	kept := get("kept")
+	get("dropped")
+	assert.ElementsMatch(t, []string{"client_http_cbstate", "client_http_bulkhead_inflight", "client_http_bulkhead_queued"},
+		gauges("dropped"))
+
+	// The transports of a dropped client are no longer observed once garbage collected.
+	require.Eventually(t, func() bool {
+		runtime.GC()
+		return len(gauges("dropped")) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{"client_http_cbstate", "client_http_bulkhead_inflight", "client_http_bulkhead_queued"},
+		gauges("kept"))
+	runtime.KeepAlive(kept)
+}
@@ -0,0 +1,28 @@
+package dialer
+
+import (
+	"fmt"
+
+	"github.com/treussart/articles/http/client/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Stats contains accumulated stats.
+type Stats struct {
+	DNSCache metric.Float64Counter
+}
+
+func GetStats(name string) (*Stats, error) {
+	meter := otel.GetMeterProvider().Meter(name)
+	dnsCache, err := meter.Float64Counter(metrics.Namespace+"client_http_dns_cache_total",
+		metric.WithDescription("Total number of DNS lookups by cache result: hit, miss, stale and negative"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("meter.Float64Counter: %w", err)
+	}
+
+	return &Stats{
+		DNSCache: dnsCache,
+	}, nil
+}
@@ -4,13 +4,109 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 )
 
+// Family is the address family used to connect.
+type Family int
+
+const (
+	// FamilyAny connects over IPv4 or IPv6, racing them with Happy Eyeballs.
+	FamilyAny Family = iota
+	// FamilyIPv4 connects over IPv4 only, e.g. when an upstream publishes broken AAAA records.
+	FamilyIPv4
+	// FamilyIPv6 connects over IPv6 only.
+	FamilyIPv6
+)
+
+// network returns network restricted to the family.
+func (f Family) network(network string) string {
+	switch {
+	case f == FamilyIPv4 && (network == "tcp" || network == "udp"):
+		return network + "4"
+	case f == FamilyIPv6 && (network == "tcp" || network == "udp"):
+		return network + "6"
+	default:
+		return network
+	}
+}
+
+type config struct {
+	connectTimeout time.Duration
+	keepAlive      time.Duration
+	fallbackDelay  time.Duration
+	family         Family
+	localAddr      net.IP
+	resolver       *Resolver
+}
+
+// Option configures the dialer created by GetDialer.
+// To apply the options to Overrides and UnixSockets, use the dialer as their Dial.
+type Option func(*config)
+
+// WithConnectTimeout set the maximum time to establish a connection, name resolution included.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(config *config) {
+		config.connectTimeout = d
+	}
+}
+
+// WithKeepAlive set the interval of the TCP keepalive probes, negative to disable them.
+func WithKeepAlive(d time.Duration) Option {
+	return func(config *config) {
+		config.keepAlive = d
+	}
+}
+
+// WithFallbackDelay set the delay before the fallback connection of Happy Eyeballs (RFC 6555),
+// negative to disable it.
+func WithFallbackDelay(d time.Duration) Option {
+	return func(config *config) {
+		config.fallbackDelay = d
+	}
+}
+
+// WithFamily set the address family used to connect.
+func WithFamily(f Family) Option {
+	return func(config *config) {
+		config.family = f
+	}
+}
+
+// WithLocalAddr set the local source address of the TCP connections.
+func WithLocalAddr(ip net.IP) Option {
+	return func(config *config) {
+		config.localAddr = ip
+	}
+}
+
+// WithResolver set the caching resolver of the host names, instead of the IP of the DNS server.
+// The other options apply to the connections to the resolved addresses.
+func WithResolver(r *Resolver) Option {
+	return func(config *config) {
+		config.resolver = r
+	}
+}
+
 // GetDialer creates a custom dialer function with specified IP and timeout, returning a function to dial contexts.
-func GetDialer(ip string, timeout time.Duration) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+// The IP of the DNS server may be empty to use the default resolver, it is not used WithResolver.
+func GetDialer(ip string, timeout time.Duration, options ...Option) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	var config config
+	for _, opt := range options {
+		opt(&config)
+	}
+
 	dialer := &net.Dialer{
-		Resolver: &net.Resolver{
+		Timeout:       config.connectTimeout,
+		KeepAlive:     config.keepAlive,
+		FallbackDelay: config.fallbackDelay,
+	}
+	if config.localAddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: config.localAddr}
+	}
+	if ip != "" {
+		dialer.Resolver = &net.Resolver{
 			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
 				d := net.Dialer{
 					Timeout: timeout,
@@ -21,7 +117,44 @@ func GetDialer(ip string, timeout time.Duration) func(ctx context.Context, netwo
 				}
 				return conn, nil
 			},
-		},
+		}
+	}
+	dial := func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, config.family.network(network), addr)
+		if err != nil {
+			return nil, fmt.Errorf("dialer.DialContext: %w", err)
+		}
+		return conn, nil
+	}
+	if config.resolver != nil {
+		fallbackDelay := config.fallbackDelay
+		if fallbackDelay == 0 {
+			fallbackDelay = defaultFallbackDelay
+		}
+		dial = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			if config.connectTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, config.connectTimeout)
+				defer cancel()
+			}
+			conn, err := config.resolver.dial(ctx, config.family.network(network), addr, dialer.DialContext, fallbackDelay)
+			if err != nil {
+				return nil, fmt.Errorf("config.resolver.dial: %w", err)
+			}
+			return conn, nil
+		}
+	}
+
+	// The other networks, e.g. the Unix sockets, have no host to resolve nor TCP local address.
+	other := &net.Dialer{Timeout: config.connectTimeout}
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		if !strings.HasPrefix(network, "tcp") && !strings.HasPrefix(network, "udp") {
+			conn, err := other.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, fmt.Errorf("other.DialContext: %w", err)
+			}
+			return conn, nil
+		}
+		return dial(ctx, network, addr)
 	}
-	return dialer.DialContext
 }
@@ -2,6 +2,7 @@ package dialer
 
 import (
 	"context"
+	"net"
 	"testing"
 	"time"
 )
@@ -81,3 +82,91 @@ func TestGetDialer(t *testing.T) {
 		})
 	}
 }
+
+func TestGetDialer_options(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	tests := []struct {
+		name      string
+		options   []Option
+		addr      string
+		wantLocal string
+		wantErr   bool
+	}{
+		{
+			name:    "IPv4",
+			options: []Option{WithFamily(FamilyIPv4), WithConnectTimeout(time.Second), WithKeepAlive(time.Second)},
+			addr:    net.JoinHostPort("127.0.0.1", port),
+		},
+		{
+			name:    "IPv6 only",
+			options: []Option{WithFamily(FamilyIPv6)},
+			addr:    net.JoinHostPort("127.0.0.1", port),
+			wantErr: true,
+		},
+		{
+			name:      "local address",
+			options:   []Option{WithLocalAddr(net.ParseIP("127.0.0.2")), WithFallbackDelay(-1)},
+			addr:      net.JoinHostPort("127.0.0.1", port),
+			wantLocal: "127.0.0.2",
+		},
+		{
+			name:    "connect timeout",
+			options: []Option{WithConnectTimeout(time.Nanosecond)},
+			addr:    net.JoinHostPort("127.0.0.1", port),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialerFunc := GetDialer("", 0, tt.options...)
+			conn, err := dialerFunc(context.Background(), "tcp", tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetDialer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			local, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+			if tt.wantLocal != "" && local != tt.wantLocal {
+				t.Errorf("GetDialer() local address = %s, want %s", local, tt.wantLocal)
+			}
+		})
+	}
+}
+
+func TestGetDialer_resolver(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	server := newDNSServer(t, map[string][]net.IP{"api.test": {net.ParseIP("::1"), net.ParseIP("127.0.0.1")}})
+
+	// the family restricts the lookups of the resolver
+	resolver := &Resolver{Servers: []string{server.addr}}
+	dialerFunc := GetDialer("", 0, WithResolver(resolver), WithFamily(FamilyIPv4), WithConnectTimeout(time.Second))
+	conn, err := dialerFunc(context.Background(), "tcp", net.JoinHostPort("api.test", port))
+	if err != nil {
+		t.Fatalf("GetDialer() error = %v", err)
+	}
+	defer conn.Close()
+	if remote, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); remote != "127.0.0.1" {
+		t.Errorf("GetDialer() remote address = %s, want 127.0.0.1", remote)
+	}
+	if server.queries.Load() != 1 {
+		t.Errorf("queries = %d, want 1", server.queries.Load())
+	}
+
+	if _, err = dialerFunc(context.Background(), "tcp", net.JoinHostPort("unknown.test", port)); err == nil {
+		t.Errorf("GetDialer() error = nil for an unknown host")
+	}
+}
@@ -0,0 +1,8 @@
+package dialer
+
+import "errors"
+
+var ErrNoServer = errors.New("no DNS server")
+var ErrInvalidAnswer = errors.New("invalid DNS answer")
+var ErrServerFailure = errors.New("DNS server failure")
+var ErrInvalidOverride = errors.New("invalid address override")
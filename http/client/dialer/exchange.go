@@ -0,0 +1,139 @@
+package dialer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Protocol is the protocol used to query the DNS servers.
+type Protocol string
+
+const (
+	// ProtocolUDP is the plain DNS, over UDP and over TCP when the answer is truncated.
+	ProtocolUDP Protocol = "udp"
+	// ProtocolTLS is DNS-over-TLS (RFC 7858).
+	ProtocolTLS Protocol = "tls"
+	// ProtocolHTTPS is DNS-over-HTTPS (RFC 8484), with the wire format.
+	ProtocolHTTPS Protocol = "https"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// roundTrip sends a DNS message to server with the protocol of the resolver.
+func (r *Resolver) roundTrip(ctx context.Context, server string, query []byte) ([]byte, error) {
+	switch r.Protocol {
+	case ProtocolTLS:
+		config := &tls.Config{MinVersion: tls.VersionTLS12}
+		if r.TLSConfig != nil {
+			config = r.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(server)
+			if err != nil {
+				return nil, fmt.Errorf("net.SplitHostPort: %w", err)
+			}
+			config.ServerName = host
+		}
+		d := &tls.Dialer{Config: config}
+		conn, err := d.DialContext(ctx, "tcp", server)
+		if err != nil {
+			return nil, fmt.Errorf("d.DialContext: %w", err)
+		}
+		return exchangeStream(ctx, conn, query)
+	case ProtocolHTTPS:
+		return r.roundTripHTTPS(ctx, server, query)
+	default:
+		answer, err := roundTrip(ctx, "udp", server, query)
+		if err == nil && truncated(answer) {
+			answer, err = roundTrip(ctx, "tcp", server, query)
+		}
+		return answer, err
+	}
+}
+
+// roundTripHTTPS posts a DNS message to the URL server.
+func (r *Resolver) roundTripHTTPS(ctx context.Context, server string, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(query))
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	client := r.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("client.Do: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status code %d", ErrServerFailure, res.StatusCode)
+	}
+	answer, err := io.ReadAll(io.LimitReader(res.Body, maxMessageSize))
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll: %w", err)
+	}
+	return answer, nil
+}
+
+// roundTrip sends a DNS message to server over UDP or TCP.
+func roundTrip(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, fmt.Errorf("d.DialContext: %w", err)
+	}
+	if network == "tcp" {
+		return exchangeStream(ctx, conn, query)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, fmt.Errorf("conn.Write: %w", err)
+	}
+	answer := make([]byte, maxMessageSize)
+	n, err := conn.Read(answer)
+	if err != nil {
+		return nil, fmt.Errorf("conn.Read: %w", err)
+	}
+	return answer[:n], nil
+}
+
+// exchangeStream sends a DNS message on a stream connection, TCP or TLS, with its length prefix and closes it.
+func exchangeStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	query = append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("conn.Write: %w", err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, fmt.Errorf("io.ReadFull: %w", err)
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, fmt.Errorf("io.ReadFull: %w", err)
+	}
+	return answer, nil
+}
+
+func truncated(answer []byte) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(answer)
+	return err == nil && h.Truncated
+}
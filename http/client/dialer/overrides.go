@@ -0,0 +1,154 @@
+package dialer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DialFunc connects to the address on the named network, like net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Overrides connects some hosts to fixed addresses, like the --resolve option of curl.
+// Only the connection changes, the host name is kept for SNI and the Host header.
+type Overrides struct {
+	// Static maps lower case "host:port", or "host" for every port, to an "ip" or "ip:port" address.
+	Static map[string]string
+	// File is a hosts-style file: an address ("ip" or "ip:port") followed by the "host" or "host:port" names,
+	// # starts a comment. Static takes precedence over File.
+	File string
+	// Interval between the checks of File for changes, 0 to check on every dial.
+	Interval time.Duration
+	// Dial connects the overridden addresses and the other hosts, net.Dialer by default.
+	Dial DialFunc
+
+	mu        sync.Mutex
+	entries   map[string]string
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// DialContext connects to the override of addr if there is one, otherwise to addr.
+func (o *Overrides) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	target, err := o.lookup(addr)
+	if err != nil {
+		return nil, fmt.Errorf("o.lookup: %w", err)
+	}
+	dial := o.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, network, target)
+	if err != nil {
+		return nil, fmt.Errorf("o.Dial: %w", err)
+	}
+	return conn, nil
+}
+
+// lookup returns the address to dial for addr.
+func (o *Overrides) lookup(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("net.SplitHostPort: %w", err)
+	}
+	entries, err := o.fileEntries()
+	if err != nil {
+		return "", fmt.Errorf("o.fileEntries: %w", err)
+	}
+	key := strings.ToLower(net.JoinHostPort(host, port))
+	host = strings.ToLower(host)
+	for _, table := range []map[string]string{o.Static, entries} {
+		for _, k := range []string{key, host} {
+			if target, ok := table[k]; ok {
+				if net.ParseIP(strings.Trim(target, "[]")) != nil {
+					return net.JoinHostPort(strings.Trim(target, "[]"), port), nil
+				}
+				return target, nil
+			}
+		}
+	}
+	return addr, nil
+}
+
+// fileEntries returns the entries of File, reloaded if it changed.
+// The previous entries are kept if the file can't be reloaded.
+func (o *Overrides) fileEntries() (map[string]string, error) {
+	if o.File == "" {
+		return nil, nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	loaded := o.entries != nil
+	now := time.Now()
+	if loaded && now.Sub(o.lastCheck) < o.Interval {
+		return o.entries, nil
+	}
+	o.lastCheck = now
+
+	info, err := os.Stat(o.File)
+	if err != nil {
+		err = fmt.Errorf("os.Stat: %w", err)
+	} else if loaded && info.ModTime().Equal(o.modTime) {
+		return o.entries, nil
+	}
+	var entries map[string]string
+	if err == nil {
+		entries, err = loadHostsFile(o.File)
+		if err != nil {
+			err = fmt.Errorf("loadHostsFile: %w", err)
+		}
+	}
+	if err != nil {
+		if !loaded {
+			// Nothing to fall back to, retry on the next dial.
+			o.lastCheck = time.Time{}
+			return nil, err
+		}
+		return o.entries, nil
+	}
+	o.entries, o.modTime = entries, info.ModTime()
+	return o.entries, nil
+}
+
+// loadHostsFile parses a hosts-style file, see Overrides.File.
+func loadHostsFile(file string) (map[string]string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || !isAddress(fields[0]) {
+			return nil, fmt.Errorf("%w: %s:%d", ErrInvalidOverride, file, line)
+		}
+		for _, name := range fields[1:] {
+			entries[strings.ToLower(name)] = fields[0]
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanner.Err: %w", err)
+	}
+	return entries, nil
+}
+
+// isAddress reports whether s is an "ip" or "ip:port" address.
+func isAddress(s string) bool {
+	if net.ParseIP(strings.Trim(s, "[]")) != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(s)
+	return err == nil && net.ParseIP(host) != nil
+}
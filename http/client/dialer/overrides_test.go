@@ -0,0 +1,102 @@
+package dialer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOverrides(t *testing.T) {
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host))
+	}))
+	defer svr.Close()
+	_, port, _ := net.SplitHostPort(svr.Listener.Addr().String())
+
+	file := filepath.Join(t.TempDir(), "hosts")
+	writeFile := func(content string, modTime time.Time) {
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatalf("os.WriteFile() error = %v", err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatalf("os.Chtimes() error = %v", err)
+		}
+	}
+	writeFile("# overrides\n127.0.0.1:"+port+" file.test:443 FILE2.test:443 # comment\n\n", time.Now())
+
+	overrides := &Overrides{
+		Static: map[string]string{
+			"example.com:443": svr.Listener.Addr().String(),
+			"ip.test":         "127.0.0.1",
+			"unknown.test":    "127.0.0.1:1",
+		},
+		File: file,
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(svr.Certificate())
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:     overrides.DialContext,
+		TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12},
+	}}
+
+	tests := []struct {
+		name    string
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{name: "host and port, certificate verified with the original host", url: "https://example.com/", want: "example.com"},
+		{name: "unknown address", url: "https://unknown.test/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := client.Get(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer response.Body.Close()
+			content, _ := io.ReadAll(response.Body)
+			if string(content) != tt.want {
+				t.Errorf("Get() = %s, want %s", content, tt.want)
+			}
+		})
+	}
+
+	target, err := overrides.lookup("ip.test:8443")
+	if err != nil || target != "127.0.0.1:8443" {
+		t.Errorf("lookup() = %s, %v", target, err)
+	}
+	target, err = overrides.lookup("file.test:443")
+	if err != nil || target != "127.0.0.1:"+port {
+		t.Errorf("lookup() = %s, %v", target, err)
+	}
+	target, err = overrides.lookup("other.test:443")
+	if err != nil || target != "other.test:443" {
+		t.Errorf("lookup() = %s, %v", target, err)
+	}
+
+	// reload, the previous entries are kept when the file is invalid
+	writeFile("[::1] file.test", time.Now().Add(time.Minute))
+	if target, _ = overrides.lookup("file.test:443"); target != "[::1]:443" {
+		t.Errorf("lookup() after reload = %s", target)
+	}
+	writeFile("file.test", time.Now().Add(2*time.Minute))
+	if target, _ = overrides.lookup("file.test:443"); target != "[::1]:443" {
+		t.Errorf("lookup() after invalid reload = %s", target)
+	}
+	_, err = (&Overrides{File: file}).lookup("file.test:443")
+	if !errors.Is(err, ErrInvalidOverride) {
+		t.Errorf("lookup() error = %v, want %v", err, ErrInvalidOverride)
+	}
+}
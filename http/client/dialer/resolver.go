@@ -0,0 +1,613 @@
+package dialer
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/treussart/articles/http/client/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	api "go.opentelemetry.io/otel/metric"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultResolverTimeout = 2 * time.Second
+	defaultNegativeTTL     = 5 * time.Second
+	defaultDialTimeout     = 30 * time.Second
+	defaultFallbackDelay   = 300 * time.Millisecond
+	// minAddrTimeout is the minimum time given to an address when the dial timeout is split, like net.Dialer.
+	minAddrTimeout = 2 * time.Second
+	sweepInterval  = time.Minute
+	maxMessageSize = math.MaxUint16
+	errNoSuchHost  = "no such host"
+)
+
+const (
+	// ReasonHit counts the lookups answered by the cache.
+	ReasonHit = "hit"
+	// ReasonMiss counts the lookups sent to the DNS servers.
+	ReasonMiss = "miss"
+	// ReasonStale counts the lookups answered by an expired entry while it is refreshed.
+	ReasonStale = "stale"
+	// ReasonNegative counts the lookups answered by a cached "no such host".
+	ReasonNegative = "negative"
+	// ReasonShared counts the lookups waiting for the same lookup in flight.
+	ReasonShared = "shared"
+)
+
+type question struct {
+	name  string
+	qtype dnsmessage.Type
+}
+
+// records are the answer to a question: the addresses, or the services of a SRV question.
+type records struct {
+	ips  []net.IP
+	srvs []*net.SRV
+}
+
+type entry struct {
+	records
+	err        error
+	expires    time.Time
+	refreshing bool
+}
+
+// call is a lookup in flight, shared by the concurrent lookups of its question.
+type call struct {
+	done chan struct{}
+	records
+	err error
+}
+
+// Resolver resolves host names with a cache respecting the TTL of the records.
+// Unknown hosts are cached for NegativeTTL, and expired entries are served for StaleTTL
+// while they are refreshed in the background, so a DNS outage doesn't fail the connections.
+type Resolver struct {
+	// Servers are the DNS servers, the next one is tried when one fails: "ip:port" addresses
+	// for ProtocolUDP, "host:port" for ProtocolTLS and URLs for ProtocolHTTPS.
+	Servers []string
+	// Protocol of the DNS servers, ProtocolUDP by default.
+	Protocol Protocol
+	// TLSConfig of ProtocolTLS connections, the server name is the host of the server by default.
+	TLSConfig *tls.Config
+	// HTTPClient sends the ProtocolHTTPS queries, http.DefaultClient by default.
+	HTTPClient *http.Client
+	// Timeout of a query to a server, 2s by default.
+	Timeout time.Duration
+	// MinTTL and MaxTTL bound the TTL of the records, 0 to keep it.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// NegativeTTL is the time "no such host" is cached, 5s by default.
+	NegativeTTL time.Duration
+	// StaleTTL is the time an expired entry can be served after its expiration, 0 to disable.
+	StaleTTL time.Duration
+	// Dial connects DialContext to the resolved addresses, net.Dialer by default.
+	// Use GetDialer WithResolver to apply the dialer options, including the family, to the lookups too.
+	Dial DialFunc
+	// DialTimeout limits the connection to the addresses of a host by DialContext when the context
+	// has no deadline, 30s by default. It is split between the addresses, so the next one is tried
+	// when one doesn't answer.
+	DialTimeout time.Duration
+	Stats       *Stats
+	ModuleName  string
+
+	mu        sync.Mutex
+	cache     map[question]*entry
+	inflight  map[question]*call
+	lastSweep time.Time
+	preferred int
+}
+
+// LookupIP looks up host for the network "ip", "ip4" or "ip6", IPv4 addresses first.
+func (r *Resolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	var qtypes []dnsmessage.Type
+	switch network {
+	case "ip":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	case "ip4":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA}
+	case "ip6":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	results := make([]struct {
+		ips []net.IP
+		err error
+	}, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var answer records
+			answer, results[i].err = r.lookup(ctx, question{name: host, qtype: qtype})
+			results[i].ips = answer.ips
+		}()
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	var err error
+	for _, result := range results {
+		ips = append(ips, result.ips...)
+		// Prefer the error of a failure to a "no such host" of the other family.
+		var dnsErr *net.DNSError
+		if result.err != nil && (err == nil || errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			err = result.err
+		}
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	return nil, err
+}
+
+// LookupSRV looks up the SRV records of name, e.g. "_http._tcp.api.internal", sorted by priority then weight.
+func (r *Resolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	answer, err := r.lookup(ctx, question{name: name, qtype: dnsmessage.TypeSRV})
+	if err != nil {
+		return nil, fmt.Errorf("r.lookup: %w", err)
+	}
+	srvs := make([]*net.SRV, 0, len(answer.srvs))
+	for _, srv := range answer.srvs {
+		srv := *srv
+		srvs = append(srvs, &srv)
+	}
+	slices.SortStableFunc(srvs, func(a, b *net.SRV) int {
+		if a.Priority != b.Priority {
+			return cmp.Compare(a.Priority, b.Priority)
+		}
+		return cmp.Compare(b.Weight, a.Weight)
+	})
+	return srvs, nil
+}
+
+// DialContext resolves the host of addr and connects to its addresses in order until one answers.
+// The addresses of the other family are raced after 300ms, with Happy Eyeballs (RFC 6555).
+func (r *Resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := r.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return r.dial(ctx, network, addr, dial, defaultFallbackDelay)
+}
+
+// dial resolves the host of addr and connects to its addresses with dial, the fallback family
+// is raced after fallbackDelay, or after the primary one if fallbackDelay is negative.
+func (r *Resolver) dial(ctx context.Context, network, addr string, dial DialFunc, fallbackDelay time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("net.SplitHostPort: %w", err)
+	}
+	ipNetwork := "ip"
+	switch network {
+	case "tcp4", "udp4":
+		ipNetwork = "ip4"
+	case "tcp6", "udp6":
+		ipNetwork = "ip6"
+	}
+	ips, err := r.LookupIP(ctx, ipNetwork, host)
+	if err != nil {
+		return nil, fmt.Errorf("r.LookupIP: %w", err)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := r.DialTimeout
+		if timeout <= 0 {
+			timeout = defaultDialTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// The primary family is the one of the first address.
+	var primaries, fallbacks []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	if fallbackDelay < 0 {
+		conn, err := dialSerial(ctx, network, port, slices.Concat(primaries, fallbacks), dial)
+		if err != nil {
+			return nil, fmt.Errorf("dialSerial: %w", err)
+		}
+		return conn, nil
+	}
+	conn, err := dialParallel(ctx, network, port, primaries, fallbacks, dial, fallbackDelay)
+	if err != nil {
+		return nil, fmt.Errorf("dialParallel: %w", err)
+	}
+	return conn, nil
+}
+
+// dialParallel connects to the primaries, and races the fallbacks once fallbackDelay expires
+// or the primaries fail. The error of the primaries is returned if both fail.
+func dialParallel(ctx context.Context, network, port string, primaries, fallbacks []net.IP,
+	dial DialFunc, fallbackDelay time.Duration) (net.Conn, error) {
+	if len(fallbacks) == 0 {
+		return dialSerial(ctx, network, port, primaries, dial)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan result, 2)
+	start := func(primary bool, ips []net.IP) {
+		conn, err := dialSerial(ctx, network, port, ips, dial)
+		results <- result{conn: conn, err: err, primary: primary}
+	}
+	go start(true, primaries)
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+	fallback := timer.C
+
+	pending := 1
+	var primaryErr error
+	for {
+		select {
+		case <-fallback:
+			fallback = nil
+			pending++
+			go start(false, fallbacks)
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// The loser is cancelled, close its connection if it won anyway.
+					go func() {
+						if loser := <-results; loser.conn != nil {
+							_ = loser.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+			}
+			if fallback != nil {
+				fallback = nil
+				pending++
+				go start(false, fallbacks)
+				continue
+			}
+			if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, res.err
+			}
+		}
+	}
+}
+
+// dialSerial connects to ips in order until one answers, the time left is split between them
+// so one address which doesn't answer doesn't prevent trying the next ones.
+func dialSerial(ctx context.Context, network, port string, ips []net.IP, dial DialFunc) (net.Conn, error) {
+	var firstErr error
+	for i, ip := range ips {
+		dialCtx := ctx
+		cancel := context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			dialCtx, cancel = context.WithDeadline(ctx, partialDeadline(time.Now(), deadline, len(ips)-i))
+		}
+		conn, err := dial(dialCtx, network, net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// partialDeadline returns the deadline of an address, among the remaining ones, like net.Dialer.
+func partialDeadline(now, deadline time.Time, remaining int) time.Time {
+	timeRemaining := deadline.Sub(now)
+	timeout := timeRemaining / time.Duration(remaining)
+	if timeout < minAddrTimeout {
+		timeout = min(timeRemaining, minAddrTimeout)
+	}
+	return now.Add(timeout)
+}
+
+func (r *Resolver) record(reason string) {
+	if r.Stats != nil {
+		r.Stats.DNSCache.Add(context.Background(), 1, api.WithAttributes(
+			attribute.String(metrics.PKGLabelName, r.ModuleName),
+			attribute.String(metrics.ReasonLabelName, reason)))
+	}
+}
+
+// lookup answers q from the cache, or from the servers if the entry is missing or expired.
+// The concurrent lookups of a missing entry share the same query.
+func (r *Resolver) lookup(ctx context.Context, q question) (records, error) {
+	now := time.Now()
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = make(map[question]*entry)
+		r.inflight = make(map[question]*call)
+	}
+	e, ok := r.cache[q]
+	switch {
+	case ok && now.Before(e.expires):
+		r.mu.Unlock()
+		if e.err != nil {
+			r.record(ReasonNegative)
+		} else {
+			r.record(ReasonHit)
+		}
+		return e.records, e.err
+	case ok && e.err == nil && now.Before(e.expires.Add(r.StaleTTL)):
+		if !e.refreshing {
+			e.refreshing = true
+			go r.refresh(q)
+		}
+		r.mu.Unlock()
+		r.record(ReasonStale)
+		return e.records, nil
+	}
+	c, ok := r.inflight[q]
+	if ok {
+		r.mu.Unlock()
+		r.record(ReasonShared)
+	} else {
+		c = &call{done: make(chan struct{})}
+		r.inflight[q] = c
+		r.mu.Unlock()
+		r.record(ReasonMiss)
+
+		// The query is not cancelled with ctx, the other lookups may wait for it.
+		go func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.timeout()*time.Duration(len(r.Servers)))
+			defer cancel()
+			c.records, c.err = r.resolve(ctx, q)
+			r.mu.Lock()
+			delete(r.inflight, q)
+			r.mu.Unlock()
+			close(c.done)
+		}()
+	}
+
+	select {
+	case <-c.done:
+		return c.records, c.err
+	case <-ctx.Done():
+		err := ctx.Err()
+		return records{}, &net.DNSError{
+			Err: err.Error(), Name: q.name, IsTimeout: errors.Is(err, context.DeadlineExceeded), UnwrapErr: err,
+		}
+	}
+}
+
+// refresh updates the stale entry of q, which is kept if the servers fail.
+func (r *Resolver) refresh(q question) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout()*time.Duration(len(r.Servers)))
+	defer cancel()
+	if _, err := r.resolve(ctx, q); err != nil {
+		r.mu.Lock()
+		if e, ok := r.cache[q]; ok {
+			e.refreshing = false
+		}
+		r.mu.Unlock()
+	}
+}
+
+// resolve queries the servers and caches the answer, or the "no such host".
+func (r *Resolver) resolve(ctx context.Context, q question) (records, error) {
+	answer, ttl, err := r.query(ctx, q)
+	var dnsErr *net.DNSError
+	notFound := errors.As(err, &dnsErr) && dnsErr.IsNotFound
+	if err != nil && !notFound {
+		return records{}, err
+	}
+	if notFound {
+		ttl = r.NegativeTTL
+		if ttl == 0 {
+			ttl = defaultNegativeTTL
+		}
+	} else {
+		ttl = max(ttl, r.MinTTL)
+		if r.MaxTTL > 0 {
+			ttl = min(ttl, r.MaxTTL)
+		}
+	}
+	now := time.Now()
+	r.mu.Lock()
+	r.cache[q] = &entry{records: answer, err: err, expires: now.Add(ttl)}
+	if now.Sub(r.lastSweep) >= sweepInterval {
+		r.sweep(now)
+		r.lastSweep = now
+	}
+	r.mu.Unlock()
+	return answer, err
+}
+
+// sweep removes the entries which expired and can't be served stale, the lock must be held.
+func (r *Resolver) sweep(now time.Time) {
+	for q, e := range r.cache {
+		if !e.refreshing && !now.Before(e.expires.Add(r.StaleTTL)) {
+			delete(r.cache, q)
+		}
+	}
+}
+
+func (r *Resolver) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return defaultResolverTimeout
+}
+
+// query sends q to the servers, starting with the last one which answered.
+func (r *Resolver) query(ctx context.Context, q question) (records, time.Duration, error) {
+	if len(r.Servers) == 0 {
+		return records{}, 0, ErrNoServer
+	}
+	r.mu.Lock()
+	start := r.preferred
+	r.mu.Unlock()
+
+	var err error
+	for i := range r.Servers {
+		n := (start + i) % len(r.Servers)
+		var answer records
+		var ttl time.Duration
+		answer, ttl, err = r.exchange(ctx, r.Servers[n], q)
+		var dnsErr *net.DNSError
+		if err == nil || errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			r.mu.Lock()
+			r.preferred = n
+			r.mu.Unlock()
+			return answer, ttl, err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return records{}, 0, err
+}
+
+// exchange sends q to server and parses its answer.
+func (r *Resolver) exchange(ctx context.Context, server string, q question) (records, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout())
+	defer cancel()
+
+	name, err := dnsmessage.NewName(fqdn(q.name))
+	if err != nil {
+		return records{}, 0, &net.DNSError{Err: err.Error(), Name: q.name, UnwrapErr: err}
+	}
+	// DoH uses the ID 0 to be cache friendly, see RFC 8484.
+	var id uint16
+	if r.Protocol != ProtocolHTTPS {
+		id = uint16(rand.N(math.MaxUint16 + 1))
+	}
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: q.qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return records{}, 0, fmt.Errorf("dnsmessage.Pack: %w", err)
+	}
+
+	answer, err := r.roundTrip(ctx, server, query)
+	if err != nil {
+		var netErr net.Error
+		timeout := errors.As(err, &netErr) && netErr.Timeout()
+		return records{}, 0, &net.DNSError{
+			Err: err.Error(), Name: q.name, Server: server, IsTimeout: timeout, IsTemporary: true, UnwrapErr: err,
+		}
+	}
+	parsed, ttl, err := parseAnswer(answer, id, q)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			dnsErr.Name, dnsErr.Server = q.name, server
+			return records{}, 0, dnsErr
+		}
+		return records{}, 0, &net.DNSError{Err: err.Error(), Name: q.name, Server: server, IsTemporary: true, UnwrapErr: err}
+	}
+	return parsed, ttl, nil
+}
+
+func fqdn(name string) string {
+	if len(name) > 0 && name[len(name)-1] == '.' {
+		return name
+	}
+	return name + "."
+}
+
+// parseAnswer returns the records of the answer to q and its TTL, the smallest of the records.
+func parseAnswer(answer []byte, id uint16, q question) (records, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(answer)
+	if err != nil {
+		return records{}, 0, fmt.Errorf("p.Start: %w", err)
+	}
+	if h.ID != id || !h.Response {
+		return records{}, 0, ErrInvalidAnswer
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return records{}, 0, &net.DNSError{Err: errNoSuchHost, IsNotFound: true}
+	default:
+		return records{}, 0, fmt.Errorf("%w: %s", ErrServerFailure, h.RCode)
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return records{}, 0, fmt.Errorf("p.SkipAllQuestions: %w", err)
+	}
+
+	var parsed records
+	ttl := uint32(math.MaxUint32)
+	for {
+		header, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return records{}, 0, fmt.Errorf("p.AnswerHeader: %w", err)
+		}
+		switch {
+		case header.Type == dnsmessage.TypeA && q.qtype == dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return records{}, 0, fmt.Errorf("p.AResource: %w", err)
+			}
+			parsed.ips = append(parsed.ips, net.IP(a.A[:]))
+		case header.Type == dnsmessage.TypeAAAA && q.qtype == dnsmessage.TypeAAAA:
+			aaaa, err := p.AAAAResource()
+			if err != nil {
+				return records{}, 0, fmt.Errorf("p.AAAAResource: %w", err)
+			}
+			parsed.ips = append(parsed.ips, net.IP(aaaa.AAAA[:]))
+		case header.Type == dnsmessage.TypeSRV && q.qtype == dnsmessage.TypeSRV:
+			srv, err := p.SRVResource()
+			if err != nil {
+				return records{}, 0, fmt.Errorf("p.SRVResource: %w", err)
+			}
+			parsed.srvs = append(parsed.srvs, &net.SRV{
+				Target: srv.Target.String(), Port: srv.Port, Priority: srv.Priority, Weight: srv.Weight,
+			})
+		default:
+			// CNAME of the chain, its TTL counts too.
+			if err := p.SkipAnswer(); err != nil {
+				return records{}, 0, fmt.Errorf("p.SkipAnswer: %w", err)
+			}
+		}
+		ttl = min(ttl, header.TTL)
+	}
+	if len(parsed.ips) == 0 && len(parsed.srvs) == 0 {
+		// The name exists without record of this type.
+		return records{}, 0, &net.DNSError{Err: errNoSuchHost, IsNotFound: true}
+	}
+	return parsed, time.Duration(ttl) * time.Second, nil
+}
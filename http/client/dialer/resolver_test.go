@@ -0,0 +1,473 @@
+package dialer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsServer is a DNS server stand-in, answering the A and AAAA records of its hosts over UDP and TCP.
+type dnsServer struct {
+	addr     string
+	queries  atomic.Int32
+	mu       sync.Mutex
+	hosts    map[string][]net.IP
+	srvs     map[string][]*net.SRV
+	ttl      uint32
+	fail     bool
+	truncate bool
+	delay    time.Duration
+}
+
+func newDNSServer(t *testing.T, hosts map[string][]net.IP) *dnsServer {
+	t.Helper()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket() error = %v", err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = udp.Close()
+		_ = tcp.Close()
+	})
+	s := &dnsServer{addr: udp.LocalAddr().String(), hosts: hosts, ttl: 60}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udp.WriteTo(s.answer(buf[:n], true), addr)
+		}
+	}()
+	go s.serveStream(tcp)
+	return s
+}
+
+// serveStream answers the queries of TCP or TLS connections.
+func (s *dnsServer) serveStream(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		var length [2]byte
+		_, _ = io.ReadFull(conn, length[:])
+		query := make([]byte, int(length[0])<<8|int(length[1]))
+		_, _ = io.ReadFull(conn, query)
+		answer := s.answer(query, false)
+		_, _ = conn.Write(append([]byte{byte(len(answer) >> 8), byte(len(answer))}, answer...))
+		_ = conn.Close()
+	}
+}
+
+// ServeHTTP answers the DoH queries.
+func (s *dnsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query, err := io.ReadAll(r.Body)
+	if err != nil || r.Method != http.MethodPost || r.Header.Get("Content-Type") != dnsMessageType {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	_, _ = w.Write(s.answer(query, false))
+}
+
+func (s *dnsServer) set(f func(s *dnsServer)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
+
+func (s *dnsServer) answer(query []byte, udp bool) []byte {
+	s.mu.Lock()
+	delay := s.delay
+	s.mu.Unlock()
+	time.Sleep(delay)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries.Add(1)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil
+	}
+	msg.Response = true
+	q := msg.Questions[0]
+	name := strings.TrimSuffix(q.Name.String(), ".")
+	ips, ok := s.hosts[name]
+	srvs, srvOK := s.srvs[name]
+	switch {
+	case s.fail:
+		msg.RCode = dnsmessage.RCodeServerFailure
+	case srvOK:
+		for _, srv := range srvs {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl},
+				Body: &dnsmessage.SRVResource{
+					Priority: srv.Priority, Weight: srv.Weight, Port: srv.Port, Target: dnsmessage.MustNewName(srv.Target),
+				},
+			})
+		}
+	case !ok:
+		msg.RCode = dnsmessage.RCodeNameError
+	case s.truncate && udp:
+		msg.Truncated = true
+	default:
+		for _, ip := range ips {
+			header := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}
+			if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte(ip4)}})
+			} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: [16]byte(ip)}})
+			}
+		}
+	}
+	answer, _ := msg.Pack()
+	return answer
+}
+
+func TestResolver_cache(t *testing.T) {
+	server := newDNSServer(t, map[string][]net.IP{
+		"api.test": {net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		"v4.test":  {net.ParseIP("127.0.0.2")},
+	})
+	reader := sdkmetric.NewManualReader()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	stats, err := GetStats("ServiceName")
+	if err != nil {
+		t.Fatalf("GetStats() error = %v", err)
+	}
+	resolver := &Resolver{Servers: []string{server.addr}, MaxTTL: 50 * time.Millisecond, Stats: stats, ModuleName: "test"}
+	ctx := context.Background()
+
+	ips, err := resolver.LookupIP(ctx, "ip", "api.test")
+	if err != nil || len(ips) != 2 || !ips[0].Equal(net.ParseIP("127.0.0.1")) || !ips[1].Equal(net.ParseIP("::1")) {
+		t.Fatalf("LookupIP() = %v, %v", ips, err)
+	}
+	if _, err = resolver.LookupIP(ctx, "ip4", "api.test"); err != nil || server.queries.Load() != 2 {
+		t.Errorf("LookupIP() from cache: queries = %d, error = %v", server.queries.Load(), err)
+	}
+
+	// expiration, bounded by MaxTTL
+	time.Sleep(60 * time.Millisecond)
+	if _, err = resolver.LookupIP(ctx, "ip4", "api.test"); err != nil || server.queries.Load() != 3 {
+		t.Errorf("LookupIP() after expiration: queries = %d, error = %v", server.queries.Load(), err)
+	}
+
+	// a family without address is not an error
+	if ips, err = resolver.LookupIP(ctx, "ip", "v4.test"); err != nil || len(ips) != 1 {
+		t.Errorf("LookupIP() = %v, %v", ips, err)
+	}
+
+	// negative caching
+	for range 2 {
+		_, err = resolver.LookupIP(ctx, "ip4", "unknown.test")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("LookupIP() error = %v, want not found", err)
+		}
+	}
+	if server.queries.Load() != 6 {
+		t.Errorf("queries = %d, want 6", server.queries.Load())
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err = reader.Collect(ctx, &rm); err != nil {
+		t.Fatalf("reader.Collect() error = %v", err)
+	}
+	lookups := map[string]float64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			for _, point := range m.Data.(metricdata.Sum[float64]).DataPoints {
+				reason, _ := point.Attributes.Value(attribute.Key("reason"))
+				lookups[reason.AsString()] += point.Value
+			}
+		}
+	}
+	want := map[string]float64{ReasonHit: 1, ReasonMiss: 6, ReasonNegative: 1}
+	if !maps.Equal(lookups, want) {
+		t.Errorf("lookups = %v, want %v", lookups, want)
+	}
+
+	// truncated answers are sent again over TCP
+	server.set(func(s *dnsServer) { s.truncate = true })
+	if ips, err = resolver.LookupIP(ctx, "ip6", "api.test"); err != nil || len(ips) != 1 {
+		t.Errorf("LookupIP() over TCP = %v, %v", ips, err)
+	}
+}
+
+func TestResolver_stale(t *testing.T) {
+	server := newDNSServer(t, map[string][]net.IP{"api.test": {net.ParseIP("127.0.0.1")}})
+	resolver := &Resolver{Servers: []string{server.addr}, MaxTTL: 10 * time.Millisecond, StaleTTL: time.Hour}
+	ctx := context.Background()
+
+	if _, err := resolver.LookupIP(ctx, "ip4", "api.test"); err != nil {
+		t.Fatalf("LookupIP() error = %v", err)
+	}
+	server.set(func(s *dnsServer) { s.fail = true })
+	for range 3 {
+		time.Sleep(20 * time.Millisecond)
+		ips, err := resolver.LookupIP(ctx, "ip4", "api.test")
+		if err != nil || len(ips) != 1 {
+			t.Errorf("LookupIP() stale = %v, %v", ips, err)
+		}
+	}
+
+	resolver = &Resolver{Servers: []string{server.addr}}
+	_, err := resolver.LookupIP(ctx, "ip4", "api.test")
+	if !errors.Is(err, ErrServerFailure) {
+		t.Errorf("LookupIP() error = %v, want %v", err, ErrServerFailure)
+	}
+}
+
+func TestResolver_shared(t *testing.T) {
+	server := newDNSServer(t, map[string][]net.IP{"api.test": {net.ParseIP("127.0.0.1")}})
+	server.set(func(s *dnsServer) { s.delay = 50 * time.Millisecond })
+	resolver := &Resolver{Servers: []string{server.addr}, MaxTTL: 10 * time.Millisecond}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ips, err := resolver.LookupIP(context.Background(), "ip4", "api.test"); err != nil || len(ips) != 1 {
+				t.Errorf("LookupIP() = %v, %v", ips, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if server.queries.Load() != 1 {
+		t.Errorf("queries = %d, want 1", server.queries.Load())
+	}
+
+	// a cancelled lookup doesn't cancel the shared query
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := resolver.LookupIP(ctx, "ip4", "api.test"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("LookupIP() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if ips, err := resolver.LookupIP(context.Background(), "ip4", "api.test"); err != nil || len(ips) != 1 {
+		t.Errorf("LookupIP() = %v, %v", ips, err)
+	}
+	if server.queries.Load() != 2 {
+		t.Errorf("queries = %d, want 2", server.queries.Load())
+	}
+
+	// expired entries are swept
+	resolver.mu.Lock()
+	resolver.sweep(time.Now().Add(time.Second))
+	size := len(resolver.cache)
+	resolver.mu.Unlock()
+	if size != 0 {
+		t.Errorf("len(cache) = %d after sweep, want 0", size)
+	}
+}
+
+func TestResolver_dial(t *testing.T) {
+	server := newDNSServer(t, map[string][]net.IP{
+		"api.test":  {net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")},
+		"dual.test": {net.ParseIP("::1"), net.ParseIP("127.0.0.2")},
+	})
+	resolver := &Resolver{Servers: []string{server.addr}}
+	var mu sync.Mutex
+	var dialed []string
+	dial := func(ctx context.Context, _, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		host, _, _ := net.SplitHostPort(addr)
+		switch host {
+		case "127.0.0.1":
+			return nil, errors.New("connection refused")
+		case "::1":
+			// blackholed
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	}
+
+	// the next address is tried when one fails
+	conn, err := resolver.dial(context.Background(), "tcp", "api.test:80", dial, defaultFallbackDelay)
+	if err != nil {
+		t.Fatalf("dial() error = %v", err)
+	}
+	_ = conn.Close()
+	if want := []string{"127.0.0.1:80", "127.0.0.2:80"}; !slices.Equal(dialed, want) {
+		t.Errorf("dialed = %v, want %v", dialed, want)
+	}
+
+	// Happy Eyeballs: the IPv4 fallback is raced after the delay
+	start := time.Now()
+	conn, err = resolver.dial(context.Background(), "tcp", "dual.test:80", dial, 20*time.Millisecond)
+	if err != nil || time.Since(start) > time.Second {
+		t.Fatalf("dial() error = %v after %v", err, time.Since(start))
+	}
+	_ = conn.Close()
+
+	// the time is split between the addresses
+	now := time.Now()
+	for _, tt := range []struct {
+		left      time.Duration
+		remaining int
+		want      time.Duration
+	}{
+		{left: 30 * time.Second, remaining: 3, want: 10 * time.Second},
+		{left: 3 * time.Second, remaining: 3, want: minAddrTimeout},
+		{left: time.Second, remaining: 3, want: time.Second},
+	} {
+		if got := partialDeadline(now, now.Add(tt.left), tt.remaining).Sub(now); got != tt.want {
+			t.Errorf("partialDeadline(%v, %d) = %v, want %v", tt.left, tt.remaining, got, tt.want)
+		}
+	}
+}
+
+func TestResolver_failover(t *testing.T) {
+	server := newDNSServer(t, map[string][]net.IP{"api.test": {net.ParseIP("127.0.0.1")}})
+	down, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket() error = %v", err)
+	}
+	_ = down.Close()
+
+	svr := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer svr.Close()
+	_, port, _ := net.SplitHostPort(svr.Listener.Addr().String())
+
+	resolver := &Resolver{Servers: []string{down.LocalAddr().String(), server.addr}, Timeout: 100 * time.Millisecond}
+	conn, err := resolver.DialContext(context.Background(), "tcp", net.JoinHostPort("api.test", port))
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	_ = conn.Close()
+	if resolver.preferred != 1 {
+		t.Errorf("preferred = %d, want 1", resolver.preferred)
+	}
+
+	resolver = &Resolver{}
+	if _, err = resolver.LookupIP(context.Background(), "ip", "api.test"); !errors.Is(err, ErrNoServer) {
+		t.Errorf("LookupIP() error = %v, want %v", err, ErrNoServer)
+	}
+}
+
+func TestResolver_encrypted(t *testing.T) {
+	server := newDNSServer(t, map[string][]net.IP{"api.test": {net.ParseIP("127.0.0.1")}})
+	doh := httptest.NewTLSServer(server)
+	defer doh.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(doh.Certificate())
+	dot, err := tls.Listen("tcp", "127.0.0.1:0", doh.TLS)
+	if err != nil {
+		t.Fatalf("tls.Listen() error = %v", err)
+	}
+	defer dot.Close()
+	go server.serveStream(dot)
+
+	tests := []struct {
+		name     string
+		resolver *Resolver
+		wantErr  bool
+	}{
+		{
+			name: "DoT",
+			resolver: &Resolver{
+				Servers:   []string{dot.Addr().String()},
+				Protocol:  ProtocolTLS,
+				TLSConfig: &tls.Config{RootCAs: roots, ServerName: "example.com", MinVersion: tls.VersionTLS12},
+			},
+		},
+		{
+			name: "DoT, unknown certificate",
+			resolver: &Resolver{
+				Servers:  []string{dot.Addr().String()},
+				Protocol: ProtocolTLS,
+			},
+			wantErr: true,
+		},
+		{
+			name: "DoH",
+			resolver: &Resolver{
+				Servers:    []string{doh.URL + "/dns-query"},
+				Protocol:   ProtocolHTTPS,
+				HTTPClient: doh.Client(),
+			},
+		},
+		{
+			name: "DoH, unknown certificate",
+			resolver: &Resolver{
+				Servers:  []string{doh.URL + "/dns-query"},
+				Protocol: ProtocolHTTPS,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips, err := tt.resolver.LookupIP(context.Background(), "ip4", "api.test")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LookupIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (len(ips) != 1 || !ips[0].Equal(net.ParseIP("127.0.0.1"))) {
+				t.Errorf("LookupIP() = %v", ips)
+			}
+		})
+	}
+}
+
+func TestResolver_LookupSRV(t *testing.T) {
+	server := newDNSServer(t, nil)
+	server.set(func(s *dnsServer) {
+		s.srvs = map[string][]*net.SRV{"_http._tcp.api.test": {
+			{Target: "backup.api.test.", Port: 8080, Priority: 20, Weight: 10},
+			{Target: "a.api.test.", Port: 8080, Priority: 10, Weight: 10},
+			{Target: "b.api.test.", Port: 8081, Priority: 10, Weight: 90},
+		}}
+	})
+	resolver := &Resolver{Servers: []string{server.addr}}
+
+	srvs, err := resolver.LookupSRV(context.Background(), "_http._tcp.api.test")
+	if err != nil {
+		t.Fatalf("LookupSRV() error = %v", err)
+	}
+	var targets []string
+	for _, srv := range srvs {
+		targets = append(targets, srv.Target)
+	}
+	want := []string{"b.api.test.", "a.api.test.", "backup.api.test."}
+	if !slices.Equal(targets, want) {
+		t.Errorf("LookupSRV() = %v, want %v", targets, want)
+	}
+
+	// the records are copies of the cache
+	srvs[0].Port = 1
+	if srvs, _ = resolver.LookupSRV(context.Background(), "_http._tcp.api.test"); srvs[0].Port != 8081 {
+		t.Errorf("LookupSRV() port = %d, want 8081", srvs[0].Port)
+	}
+	if _, err = resolver.LookupSRV(context.Background(), "_http._tcp.unknown.test"); err == nil {
+		t.Errorf("LookupSRV() error = nil, want not found")
+	}
+}
@@ -0,0 +1,49 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// UnixSockets connects pseudo-hosts to Unix domain sockets, e.g. "http://agent/metrics" to /run/agent.sock,
+// so sidecars listening on sockets are called like the other hosts.
+// The pseudo-hosts must be bypassed if a proxy is configured.
+type UnixSockets struct {
+	// Paths maps lower case pseudo-hosts, "host:port" or "host" for every port, to the socket paths,
+	// as a file path or a "unix:///run/agent.sock" URL.
+	Paths map[string]string
+	// Dial connects the sockets and the other hosts, net.Dialer by default.
+	Dial DialFunc
+}
+
+// DialContext connects to the socket of the pseudo-host of addr, or to addr for the other hosts.
+func (u *UnixSockets) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := u.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	if path, ok := u.path(addr); ok {
+		network, addr = "unix", path
+	}
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("u.Dial: %w", err)
+	}
+	return conn, nil
+}
+
+// path returns the socket path of the pseudo-host of addr.
+func (u *UnixSockets) path(addr string) (string, bool) {
+	keys := []string{strings.ToLower(addr)}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		keys = append(keys, strings.ToLower(host))
+	}
+	for _, key := range keys {
+		if path, ok := u.Paths[key]; ok {
+			return strings.TrimPrefix(path, "unix://"), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,107 @@
+package dialer
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixSockets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	socket := &httptest.Server{
+		Listener: l,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("socket " + r.Host + r.URL.Path))
+		})},
+	}
+	socket.Start()
+	defer socket.Close()
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("tcp"))
+	}))
+	defer svr.Close()
+
+	sockets := &UnixSockets{Paths: map[string]string{
+		"agent":         path,
+		"proxy.sock:80": "unix://" + path,
+	}}
+	client := &http.Client{Transport: &http.Transport{DialContext: sockets.DialContext}}
+
+	tests := []struct {
+		name    string
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{name: "pseudo-host", url: "http://agent/metrics", want: "socket agent/metrics"},
+		{name: "pseudo-host, other port", url: "http://AGENT:8080/", want: "socket AGENT:8080/"},
+		{name: "pseudo-host and port, unix URL", url: "http://proxy.sock/", want: "socket proxy.sock/"},
+		{name: "other host", url: svr.URL, want: "tcp"},
+		{name: "pseudo-host and other port", url: "http://proxy.sock:81/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := client.Get(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer response.Body.Close()
+			content, _ := io.ReadAll(response.Body)
+			if string(content) != tt.want {
+				t.Errorf("Get() = %s, want %s", content, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnixSockets_dial(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	defer l.Close()
+
+	// the sockets are connected with Dial, so the dialer options apply
+	tests := []struct {
+		name    string
+		options []Option
+	}{
+		{name: "connect timeout", options: []Option{WithConnectTimeout(time.Second)}},
+		{name: "resolver", options: []Option{WithResolver(&Resolver{Servers: []string{"127.0.0.1:1"}})}},
+		{name: "local address", options: []Option{WithLocalAddr(net.ParseIP("127.0.0.1"))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var networks []string
+			dial := GetDialer("", 0, tt.options...)
+			sockets := &UnixSockets{
+				Paths: map[string]string{"agent": path},
+				Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					networks = append(networks, network)
+					return dial(ctx, network, addr)
+				},
+			}
+			conn, err := sockets.DialContext(context.Background(), "tcp", "agent:80")
+			if err != nil {
+				t.Fatalf("DialContext() error = %v", err)
+			}
+			_ = conn.Close()
+			if len(networks) != 1 || networks[0] != "unix" {
+				t.Errorf("Dial() networks = %v, want [unix]", networks)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package discovery
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy selects the endpoint of a request.
+type Strategy int
+
+const (
+	// RoundRobin selects the endpoints in turn.
+	RoundRobin Strategy = iota
+	// LeastOutstanding selects the endpoint with the fewest in-flight requests.
+	LeastOutstanding
+	// PowerOfTwoChoices selects the endpoint with the fewest in-flight requests among two random ones.
+	PowerOfTwoChoices
+)
+
+// String implements stringer interface.
+func (s Strategy) String() string {
+	switch s {
+	case RoundRobin:
+		return "round-robin"
+	case LeastOutstanding:
+		return "least-outstanding"
+	case PowerOfTwoChoices:
+		return "power-of-two-choices"
+	default:
+		return fmt.Sprintf("unknown strategy: %d", s)
+	}
+}
+
+type endpoint struct {
+	addr        string
+	outstanding atomic.Int64
+	// tripper sends the requests to addr, created on the first one.
+	trMu    sync.Mutex
+	tripper http.RoundTripper
+	// failures and ejectedUntil are guarded by the lock of the pool.
+	failures     int
+	ejectedUntil time.Time
+}
+
+// pool is the endpoints of a service, refreshed every RefreshInterval.
+type pool struct {
+	mu         sync.Mutex
+	endpoints  []*endpoint
+	refreshed  time.Time
+	refreshing bool
+	next       atomic.Uint64
+}
+
+// update replaces the endpoints by addrs, the known ones keep their state.
+// It returns the endpoints which are removed.
+func (p *pool) update(addrs []string, now time.Time) []*endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	known := make(map[string]*endpoint, len(p.endpoints))
+	for _, e := range p.endpoints {
+		known[e.addr] = e
+	}
+	endpoints := make([]*endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		e, ok := known[addr]
+		if !ok {
+			e = &endpoint{addr: addr}
+		}
+		delete(known, addr)
+		endpoints = append(endpoints, e)
+	}
+	p.endpoints = endpoints
+	p.refreshed = now
+	p.refreshing = false
+	removed := make([]*endpoint, 0, len(known))
+	for _, e := range known {
+		removed = append(removed, e)
+	}
+	return removed
+}
+
+// failed ends a refresh which failed, the next one is after the refresh interval since now.
+func (p *pool) failed(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refreshed = now
+	p.refreshing = false
+}
+
+// pick selects an endpoint with strategy, among the endpoints not ejected.
+// All the endpoints are candidates if they are all ejected, rather than failing every request.
+func (p *pool) pick(strategy Strategy, now time.Time) *endpoint {
+	p.mu.Lock()
+	candidates := make([]*endpoint, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		if !now.Before(e.ejectedUntil) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, p.endpoints...)
+	}
+	p.mu.Unlock()
+
+	n := len(candidates)
+	if n == 0 {
+		return nil
+	}
+	switch strategy {
+	case LeastOutstanding:
+		// Start in turn so the ties are spread.
+		start := int(p.next.Add(1) % uint64(n))
+		best := candidates[start]
+		for i := 1; i < n; i++ {
+			if e := candidates[(start+i)%n]; e.outstanding.Load() < best.outstanding.Load() {
+				best = e
+			}
+		}
+		return best
+	case PowerOfTwoChoices:
+		if n == 1 {
+			return candidates[0]
+		}
+		i := rand.N(n)
+		j := rand.N(n - 1)
+		if j >= i {
+			j++
+		}
+		if candidates[j].outstanding.Load() < candidates[i].outstanding.Load() {
+			return candidates[j]
+		}
+		return candidates[i]
+	default:
+		return candidates[(p.next.Add(1)-1)%uint64(n)]
+	}
+}
+
+// report records the outcome of a request to e, and reports whether e is ejected
+// after maxFailures consecutive failures.
+func (p *pool) report(e *endpoint, success bool, maxFailures int, ejectionTime time.Duration, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if success {
+		e.failures = 0
+		return false
+	}
+	e.failures++
+	if maxFailures <= 0 || e.failures < maxFailures || now.Before(e.ejectedUntil) {
+		return false
+	}
+	e.failures = 0
+	e.ejectedUntil = now.Add(ejectionTime)
+	return true
+}
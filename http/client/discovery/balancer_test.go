@@ -0,0 +1,82 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestPool(outstanding ...int64) *pool {
+	p := &pool{}
+	addrs := make([]string, 0, len(outstanding))
+	for i := range outstanding {
+		addrs = append(addrs, string(rune('a'+i)))
+	}
+	p.update(addrs, time.Now())
+	for i, n := range outstanding {
+		p.endpoints[i].outstanding.Store(n)
+	}
+	return p
+}
+
+func TestPool_pick(t *testing.T) {
+	tests := []struct {
+		name        string
+		strategy    Strategy
+		outstanding []int64
+		ejected     []int
+		want        map[string]int
+	}{
+		{name: "round-robin", strategy: RoundRobin, outstanding: []int64{5, 0, 0}, want: map[string]int{"a": 2, "b": 2, "c": 2}},
+		{name: "round-robin, ejected", strategy: RoundRobin, outstanding: []int64{0, 0, 0}, ejected: []int{1}, want: map[string]int{"a": 3, "c": 3}},
+		{name: "round-robin, all ejected", strategy: RoundRobin, outstanding: []int64{0, 0}, ejected: []int{0, 1}, want: map[string]int{"a": 3, "b": 3}},
+		{name: "least outstanding", strategy: LeastOutstanding, outstanding: []int64{3, 1, 2}, want: map[string]int{"b": 6}},
+		{name: "least outstanding, ties", strategy: LeastOutstanding, outstanding: []int64{0, 0, 2}, want: map[string]int{"a": 4, "b": 2}},
+		{name: "power of two choices", strategy: PowerOfTwoChoices, outstanding: []int64{4, 0}, want: map[string]int{"b": 6}},
+		{name: "power of two choices, one endpoint", strategy: PowerOfTwoChoices, outstanding: []int64{4}, want: map[string]int{"a": 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPool(tt.outstanding...)
+			now := time.Now()
+			for _, i := range tt.ejected {
+				p.endpoints[i].ejectedUntil = now.Add(time.Minute)
+			}
+			got := map[string]int{}
+			for range 6 {
+				got[p.pick(tt.strategy, now).addr]++
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("pick() = %v, want %v", got, tt.want)
+			}
+			for addr, n := range tt.want {
+				if got[addr] != n {
+					t.Errorf("pick() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPool_report(t *testing.T) {
+	p := newTestPool(0)
+	e := p.endpoints[0]
+	now := time.Now()
+	if p.report(e, false, 2, time.Minute, now) {
+		t.Errorf("report() ejected after 1 failure")
+	}
+	if p.report(e, true, 2, time.Minute, now) || p.report(e, false, 2, time.Minute, now) {
+		t.Errorf("report() ejected after a success")
+	}
+	if !p.report(e, false, 2, time.Minute, now) {
+		t.Errorf("report() not ejected after 2 failures")
+	}
+	if p.pick(RoundRobin, now.Add(time.Minute)) != e {
+		t.Errorf("pick() endpoint not re-admitted after the ejection time")
+	}
+
+	// kept with the updates of the endpoints
+	p.update([]string{"a", "b"}, now)
+	if p.endpoints[0] != e || !e.ejectedUntil.Equal(now.Add(time.Minute)) {
+		t.Errorf("update() lost the state of the endpoint")
+	}
+}
@@ -0,0 +1,28 @@
+package discovery
+
+import (
+	"fmt"
+
+	"github.com/treussart/articles/http/client/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Stats contains accumulated stats.
+type Stats struct {
+	Ejection metric.Float64Counter
+}
+
+func GetStats(name string) (*Stats, error) {
+	meter := otel.GetMeterProvider().Meter(name)
+	ejection, err := meter.Float64Counter(metrics.Namespace+"client_http_endpoint_ejection_total",
+		metric.WithDescription("Total number of endpoints ejected by the outlier detection"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("meter.Float64Counter: %w", err)
+	}
+
+	return &Stats{
+		Ejection: ejection,
+	}, nil
+}
@@ -0,0 +1,5 @@
+package discovery
+
+import "errors"
+
+var ErrNoEndpoint = errors.New("no endpoint")
@@ -0,0 +1,265 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/treussart/articles/http/client/internal/body"
+	"github.com/treussart/articles/http/client/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	api "go.opentelemetry.io/otel/metric"
+)
+
+const (
+	defaultRefreshInterval = 30 * time.Second
+	defaultEjectionTime    = 30 * time.Second
+	defaultResolveTimeout  = 10 * time.Second
+)
+
+// Resolver looks up the endpoints of the services, implemented by dialer.Resolver.
+type Resolver interface {
+	LookupSRV(ctx context.Context, name string) ([]*net.SRV, error)
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// Transport balances the requests to the hosts of services between the endpoints of the service.
+// The request URL is kept, only the connections are dialed to the endpoint: with https,
+// the server name and certificate verification use the host of the service.
+type Transport struct {
+	// Tripper sends the requests to the hosts which are not services.
+	Tripper http.RoundTripper
+	// NewTripper returns the tripper of an endpoint, its connections must be dialed to addr, see DialEndpoint.
+	// Each endpoint has its own connections, so the requests are balanced on kept-alive connections too.
+	// It defaults to a http.Transport without proxy.
+	NewTripper func(addr string) http.RoundTripper
+	Resolver   Resolver
+	// Services maps the lower case hosts of the request URLs, "host:port" or "host" for every port, to their service:
+	// a SRV name like "_http._tcp.api.internal", starting with "_", or a host name whose A and AAAA records
+	// are the endpoints, with the port of the request. Requests to other hosts are sent as is.
+	// With SRV records, the endpoints are the targets of the lowest priority.
+	Services map[string]string
+	Strategy Strategy
+	// RefreshInterval is the time between the lookups of the endpoints, 30s by default.
+	// Endpoints are refreshed in the background, the previous ones are kept if the lookup fails.
+	RefreshInterval time.Duration
+	// MaxFailures is the number of consecutive failures (errors and 5xx) ejecting an endpoint
+	// for EjectionTime (30s by default), 0 to disable the outlier detection.
+	MaxFailures  int
+	EjectionTime time.Duration
+	Stats        *Stats
+	ModuleName   string
+
+	mu    sync.Mutex
+	pools map[string]*pool
+}
+
+// service returns the service of the host of u and the port of the request.
+func (t *Transport) service(u *url.URL) (string, string, bool) {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	host := strings.ToLower(u.Hostname())
+	if service, ok := t.Services[net.JoinHostPort(host, port)]; ok {
+		return service, port, true
+	}
+	service, ok := t.Services[host]
+	return service, port, ok
+}
+
+func (t *Transport) pool(key string) *pool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pools == nil {
+		t.pools = make(map[string]*pool)
+	}
+	p, ok := t.pools[key]
+	if !ok {
+		p = &pool{}
+		t.pools[key] = p
+	}
+	return p
+}
+
+// resolve looks up the endpoints of service.
+func (t *Transport) resolve(ctx context.Context, service, port string) ([]string, error) {
+	if !strings.HasPrefix(service, "_") {
+		ips, err := t.Resolver.LookupIP(ctx, "ip", service)
+		if err != nil {
+			return nil, fmt.Errorf("t.Resolver.LookupIP: %w", err)
+		}
+		addrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+		return addrs, nil
+	}
+
+	srvs, err := t.Resolver.LookupSRV(ctx, service)
+	if err != nil {
+		return nil, fmt.Errorf("t.Resolver.LookupSRV: %w", err)
+	}
+	var addrs []string
+	for _, srv := range srvs {
+		// "." means the service is not available.
+		target := strings.TrimSuffix(srv.Target, ".")
+		if srv.Priority != srvs[0].Priority || target == "" {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(target, strconv.Itoa(int(srv.Port))))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoEndpoint, service)
+	}
+	return addrs, nil
+}
+
+// refresh looks up the endpoints of p, in the background if it already has some.
+func (t *Transport) refresh(ctx context.Context, p *pool, service, port string) error {
+	interval := t.RefreshInterval
+	if interval <= 0 {
+		interval = defaultRefreshInterval
+	}
+	now := time.Now()
+	p.mu.Lock()
+	loaded := len(p.endpoints) > 0
+	if loaded && (now.Sub(p.refreshed) < interval || p.refreshing) {
+		p.mu.Unlock()
+		return nil
+	}
+	p.refreshing = true
+	p.mu.Unlock()
+
+	if !loaded {
+		addrs, err := t.resolve(ctx, service, port)
+		if err != nil {
+			p.failed(time.Time{})
+			return fmt.Errorf("t.resolve: %w", err)
+		}
+		t.close(p.update(addrs, now))
+		return nil
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultResolveTimeout)
+		defer cancel()
+		addrs, err := t.resolve(ctx, service, port)
+		if err != nil {
+			// Keep the previous endpoints, retry after the next interval.
+			p.failed(time.Now())
+			return
+		}
+		t.close(p.update(addrs, time.Now()))
+	}()
+	return nil
+}
+
+// tripper returns the tripper of e, creating it on the first request.
+func (t *Transport) tripper(e *endpoint) http.RoundTripper {
+	e.trMu.Lock()
+	defer e.trMu.Unlock()
+	if e.tripper == nil {
+		newTripper := t.NewTripper
+		if newTripper == nil {
+			newTripper = newTransport
+		}
+		e.tripper = newTripper(e.addr)
+	}
+	return e.tripper
+}
+
+// close closes the idle connections of the removed endpoints, the in-flight ones are closed once idle.
+func (t *Transport) close(removed []*endpoint) {
+	for _, e := range removed {
+		e.trMu.Lock()
+		tr, ok := e.tripper.(interface{ CloseIdleConnections() })
+		e.trMu.Unlock()
+		if ok {
+			tr.CloseIdleConnections()
+		}
+	}
+}
+
+func (t *Transport) recordEjection(service, addr string) {
+	if t.Stats != nil {
+		t.Stats.Ejection.Add(context.Background(), 1, api.WithAttributes(
+			attribute.String(metrics.PKGLabelName, t.ModuleName),
+			attribute.String(metrics.NameLabelName, service),
+			attribute.String(metrics.HostLabelName, addr)))
+	}
+}
+
+// RoundTrip implements http.RoundTripper interface.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	service, port, ok := t.service(req.URL)
+	if !ok {
+		res, err := t.Tripper.RoundTrip(req)
+		if err != nil {
+			return nil, fmt.Errorf("t.Tripper.RoundTrip: %w", err)
+		}
+		return res, nil
+	}
+	p := t.pool(service + " " + port)
+	if err := t.refresh(req.Context(), p, service, port); err != nil {
+		return nil, fmt.Errorf("t.refresh: %w", err)
+	}
+	e := p.pick(t.Strategy, time.Now())
+	if e == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoEndpoint, service)
+	}
+
+	e.outstanding.Add(1)
+	res, err := t.tripper(e).RoundTrip(req)
+
+	// The cancellations and timeouts of the caller don't tell anything about the endpoint.
+	if req.Context().Err() == nil {
+		ejectionTime := t.EjectionTime
+		if ejectionTime <= 0 {
+			ejectionTime = defaultEjectionTime
+		}
+		success := err == nil && res.StatusCode < http.StatusInternalServerError
+		if p.report(e, success, t.MaxFailures, ejectionTime, time.Now()) {
+			t.recordEjection(service, e.addr)
+		}
+	}
+	if err != nil {
+		e.outstanding.Add(-1)
+		return nil, fmt.Errorf("t.tripper.RoundTrip: %w", err)
+	}
+	// The outstanding request of the endpoint ends when the response body is closed.
+	res.Body = body.OnClose(res.Body, sync.OnceFunc(func() { e.outstanding.Add(-1) }))
+	return res, nil
+}
+
+// DialEndpoint returns a dial function connecting to addr, whatever the address it is called with.
+// dial defaults to a net.Dialer.
+func DialEndpoint(dial func(ctx context.Context, network, addr string) (net.Conn, error),
+	addr string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return dial(ctx, network, addr)
+	}
+}
+
+// newTransport is the default NewTripper.
+func newTransport(addr string) http.RoundTripper {
+	return &http.Transport{
+		DialContext:           DialEndpoint(nil, addr),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
@@ -0,0 +1,48 @@
+package hedged
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// latencySamples is the number of recent latencies kept to compute the percentile.
+	latencySamples = 512
+	// minLatencySamples is the number of latencies needed before using the percentile.
+	minLatencySamples = 20
+)
+
+// latencies keeps the most recent latencies in a ring buffer.
+type latencies struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (l *latencies) record(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencySamples
+}
+
+// percentile returns the p percentile (0 < p <= 1) of the recorded latencies,
+// false if not enough latencies were recorded.
+func (l *latencies) percentile(p float64) (time.Duration, bool) {
+	l.mu.Lock()
+	if len(l.samples) < minLatencySamples {
+		l.mu.Unlock()
+		return 0, false
+	}
+	sorted := slices.Clone(l.samples)
+	l.mu.Unlock()
+
+	slices.Sort(sorted)
+	i := int(p*float64(len(sorted))+0.5) - 1
+	return sorted[max(0, min(i, len(sorted)-1))], true
+}
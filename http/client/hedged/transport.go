@@ -0,0 +1,193 @@
+package hedged
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/treussart/articles/http/client/internal/body"
+	"github.com/treussart/articles/http/client/metrics"
+	"github.com/treussart/articles/http/client/retryable"
+	"go.opentelemetry.io/otel/attribute"
+	api "go.opentelemetry.io/otel/metric"
+)
+
+// Reasons recorded with the Hedge stats.
+const (
+	// ReasonSent is recorded when a hedged request is sent.
+	ReasonSent = "sent"
+	// ReasonWon is recorded when a hedged request returns the first successful response.
+	ReasonWon = "won"
+)
+
+// Transport sends copies of slow idempotent requests and returns the first successful response.
+// Below a retryable.Transport, each attempt is hedged: a request makes up to (1+RetryMax)*(1+MaxHedges) calls,
+// unless the hedged requests are limited by the Budget of the retries.
+type Transport struct {
+	Tripper http.RoundTripper
+	// Delay is the wait before sending a hedged request, also used until enough latencies
+	// are observed when Percentile is set. With a Percentile and no Delay, requests are not hedged
+	// until enough latencies are observed.
+	Delay time.Duration
+	// MaxHedges is the number of copies sent in addition to the request, 1 if 0.
+	MaxHedges int
+	// Percentile, if set, sends the hedged requests after this percentile of the observed latencies, e.g. 0.95.
+	Percentile float64
+	// Budget, if set, is shared with the retries: each hedged request withdraws from it.
+	Budget     *retryable.Budget
+	Stats      *retryable.Stats
+	ModuleName string
+
+	latencies latencies
+}
+
+type result struct {
+	index int
+	resp  *http.Response
+	err   error
+}
+
+func successful(res result) bool {
+	return res.err == nil && res.resp.StatusCode < http.StatusInternalServerError
+}
+
+// hedgeable reports whether req can be sent several times.
+func hedgeable(req *http.Request) bool {
+	if !retryable.IsIdempotent(req) {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// delay returns the wait before sending the next hedged request, false if none is sent.
+func (t *Transport) delay() (time.Duration, bool) {
+	if t.Percentile > 0 {
+		if d, ok := t.latencies.percentile(t.Percentile); ok {
+			return d, true
+		}
+	}
+	return t.Delay, t.Delay > 0
+}
+
+// arm starts timer for the next hedged request, if any.
+func (t *Transport) arm(timer *time.Timer) {
+	if d, ok := t.delay(); ok {
+		timer.Reset(d)
+	}
+}
+
+func (t *Transport) record(reason string) {
+	if t.Stats != nil {
+		t.Stats.Hedge.Add(context.Background(), 1, api.WithAttributes(
+			attribute.String(metrics.PKGLabelName, t.ModuleName),
+			attribute.String(metrics.ReasonLabelName, reason)))
+	}
+}
+
+// send sends the copy number index of req in the background, the first copy uses the body of req.
+func (t *Transport) send(req *http.Request, index int, results chan<- result) (context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	r := req.Clone(ctx)
+	if index > 0 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("req.GetBody: %w", err)
+		}
+		r.Body = body
+	}
+	go func() {
+		start := time.Now()
+		resp, err := t.Tripper.RoundTrip(r)
+		if err == nil {
+			t.latencies.record(time.Since(start))
+		}
+		results <- result{index: index, resp: resp, err: err}
+	}()
+	return cancel, nil
+}
+
+// RoundTrip sends the request, then a hedged copy each time the delay expires without a successful response.
+// Losing requests are cancelled and their responses drained.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !hedgeable(req) {
+		resp, err := t.Tripper.RoundTrip(req)
+		if err != nil {
+			return nil, fmt.Errorf("t.Tripper.RoundTrip: %w", err)
+		}
+		return resp, nil
+	}
+	maxHedges := t.MaxHedges
+	if maxHedges <= 0 {
+		maxHedges = 1
+	}
+
+	results := make(chan result, maxHedges+1)
+	cancel, err := t.send(req, 0, results)
+	if err != nil {
+		return nil, fmt.Errorf("t.send: %w", err)
+	}
+	cancels := []context.CancelFunc{cancel}
+	received := 0
+	timer := time.NewTimer(0)
+	timer.Stop()
+	defer timer.Stop()
+	t.arm(timer)
+
+	// next sends the next hedged request, if it is allowed, and reports whether it was sent.
+	next := func() bool {
+		if len(cancels) > maxHedges || req.Context().Err() != nil {
+			return false
+		}
+		if t.Budget != nil && !t.Budget.Withdraw() {
+			return false
+		}
+		cancel, err := t.send(req, len(cancels), results)
+		if err != nil {
+			return false
+		}
+		cancels = append(cancels, cancel)
+		t.record(ReasonSent)
+		t.arm(timer)
+		return true
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			next()
+		case res := <-results:
+			received++
+			// When every request sent failed, the next hedged request is sent right away.
+			if !successful(res) && (received < len(cancels) || next()) {
+				body.Drain(res.resp)
+				cancels[res.index]()
+				continue
+			}
+			if successful(res) && res.index > 0 {
+				t.record(ReasonWon)
+			}
+
+			// Cancel the losers and drain their responses in the background.
+			for i, cancel := range cancels {
+				if i != res.index {
+					cancel()
+				}
+			}
+			go func(pending int) {
+				for range pending {
+					body.Drain((<-results).resp)
+				}
+			}(len(cancels) - received)
+
+			if res.err != nil {
+				cancels[res.index]()
+				return nil, fmt.Errorf("t.Tripper.RoundTrip: %w", res.err)
+			}
+			// The context of the request is cancelled when its response body is closed.
+			res.resp.Body = body.OnClose(res.resp.Body, cancels[res.index])
+			return res.resp, nil
+		}
+	}
+}
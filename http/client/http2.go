@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/treussart/articles/http/client/bulkhead"
+	"golang.org/x/net/http2"
+)
+
+// configureHTTP2 enables HTTP/2 over TLS and prior knowledge h2c (HTTP/2 without TLS) on tr.
+// With HTTP/2 the concurrency limits the in-flight streams per host, the idle connections don't matter
+// since the requests are multiplexed. The streams are limited even with WithBulkhead, whose requests
+// can make several calls with the retries and the hedged requests.
+func configureHTTP2(tr *http.Transport, config customConfig) http.RoundTripper {
+	if !config.http2 && !config.h2c {
+		return tr
+	}
+	if config.http2 {
+		// A custom dialer disables HTTP/2 unless it is forced.
+		tr.ForceAttemptHTTP2 = true
+		// Fails only if the transport is already configured for HTTP/2.
+		if h2, err := http2.ConfigureTransports(tr); err == nil {
+			h2.ReadIdleTimeout = config.http2ReadIdleTimeout
+			h2.PingTimeout = config.http2PingTimeout
+			h2.StrictMaxConcurrentStreams = true
+		}
+	}
+	if config.h2c {
+		dial := tr.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		tr.RegisterProtocol("http", &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+			DisableCompression:         tr.DisableCompression,
+			IdleConnTimeout:            tr.IdleConnTimeout,
+			ReadIdleTimeout:            config.http2ReadIdleTimeout,
+			PingTimeout:                config.http2PingTimeout,
+			StrictMaxConcurrentStreams: true,
+		})
+	}
+	if config.concurrency <= 0 {
+		return tr
+	}
+	return &bulkhead.Transport{
+		Tripper:     tr,
+		MaxInFlight: config.concurrency,
+		MaxQueue:    -1,
+	}
+}
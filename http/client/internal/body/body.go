@@ -0,0 +1,34 @@
+// Package body handles the response bodies for the transports of the client.
+package body
+
+import (
+	"io"
+	"net/http"
+)
+
+// RespReadLimit is the size of a response body consumed to keep its connection, a larger body closes it.
+const RespReadLimit = int64(4096)
+
+// Drain consumes up to RespReadLimit of the body of resp and closes it, so its connection can be reused.
+func Drain(resp *http.Response) {
+	if resp != nil && resp.Body != nil {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, RespReadLimit))
+		_ = resp.Body.Close()
+	}
+}
+
+// OnClose returns rc calling f each time it is closed, e.g. to cancel the context of the request
+// or to release its slot. f must be idempotent.
+func OnClose(rc io.ReadCloser, f func()) io.ReadCloser {
+	return &closer{ReadCloser: rc, f: f}
+}
+
+type closer struct {
+	io.ReadCloser
+	f func()
+}
+
+func (c *closer) Close() error {
+	defer c.f()
+	return c.ReadCloser.Close()
+}
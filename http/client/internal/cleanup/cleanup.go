@@ -0,0 +1,18 @@
+// Package cleanup ties a cleanup to the lifetime of the transports of the client.
+package cleanup
+
+import "runtime"
+
+// Handle calls its cleanup once it is garbage collected, its owner keeps it so the cleanup runs
+// once the owner is unreachable, e.g. to stop observing a transport dropped with its client.
+type Handle struct {
+	f func()
+}
+
+// New returns a Handle calling f once it is unreachable.
+// f must not reference the owner of the handle, or they are never collected.
+func New(f func()) *Handle {
+	h := &Handle{f: f}
+	runtime.SetFinalizer(h, func(h *Handle) { h.f() })
+	return h
+}
@@ -5,8 +5,13 @@ import (
 )
 
 const (
-	PKGLabelName = "pkg"
-	Namespace    = ""
+	PKGLabelName    = "pkg"
+	NameLabelName   = "name"
+	HostLabelName   = "host"
+	ReasonLabelName = "reason"
+	FromLabelName   = "from"
+	ToLabelName     = "to"
+	Namespace       = ""
 )
 
 // MeasureDuration calculates the time elapsed since the start time and returns it in seconds.
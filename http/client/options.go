@@ -3,10 +3,16 @@ package client
 import (
 	"context"
 	"net"
+	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/sony/gobreaker/v2"
+	"github.com/treussart/articles/http/client/bulkhead"
 	"github.com/treussart/articles/http/client/circuitbreaker"
+	"github.com/treussart/articles/http/client/discovery"
 	"github.com/treussart/articles/http/client/retryable"
+	"github.com/treussart/articles/http/client/tlsconfig"
 )
 
 type customConfig struct {
@@ -15,6 +21,17 @@ type customConfig struct {
 	retryMax              int
 	retryWaitMin          time.Duration
 	retryWaitMax          time.Duration
+	retryPolicy           retryable.RetryPolicy
+	backoff               retryable.Backoff
+	idempotencyKey        bool
+	retryBudget           *retryable.Budget
+	maxBufferedBody       int64
+	attemptTimeout        time.Duration
+	attemptHeader         bool
+	onRetry               retryable.OnRetry
+	hedgeDelay            time.Duration
+	hedgeMax              int
+	hedgePercentile       float64
 	retryStats            *retryable.Stats
 	circuitBreakerStats   *circuitbreaker.Stats
 	moduleName            string
@@ -25,9 +42,47 @@ type customConfig struct {
 	cbMaxRequests         uint32
 	cbTimeout             time.Duration
 	cbSatusCodeMax        int
+	cbKeyFunc             circuitbreaker.KeyFunc
+	cbIdleTimeout         time.Duration
+	cbInterval            time.Duration
+	cbBucketPeriod        time.Duration
+	cbMinRequests         uint32
+	cbFailureRatio        float64
+	cbReadyToTrip         func(counts gobreaker.Counts) bool
+	cbOnStateChange       func(name string, from gobreaker.State, to gobreaker.State)
+	cbFallback            circuitbreaker.Fallback
+	cbFailureStatusCodes  []int
+	cbIsSuccessful        func(err error) bool
+	cbRegistry            *circuitbreaker.Registry
 	enableCircuitBreaker  bool
 	insecureSkipVerify    bool
+	tlsSource             tlsconfig.Source
+	tlsReloadInterval     time.Duration
+	tlsMinVersion         uint16
+	tlsCipherSuites       []uint16
+	tlsServerName         string
+	tlsPins               tlsconfig.Pins
+	tlsStats              *tlsconfig.Stats
 	proxyHost             string
+	proxyURL              *url.URL
+	proxyFromEnvironment  bool
+	proxyBypass           []string
+	proxyConnectHeader    http.Header
+	http2                 bool
+	h2c                   bool
+	http2ReadIdleTimeout  time.Duration
+	http2PingTimeout      time.Duration
+	discoveryResolver     discovery.Resolver
+	discoveryServices     map[string]string
+	discoveryStrategy     discovery.Strategy
+	discoveryRefresh      time.Duration
+	outlierMaxFailures    int
+	outlierEjectionTime   time.Duration
+	discoveryStats        *discovery.Stats
+	bulkheadMaxInFlight   int
+	bulkheadMaxQueue      int
+	bulkheadQueueTimeout  time.Duration
+	bulkheadStats         *bulkhead.Stats
 }
 
 type CustomOption func(*customConfig)
@@ -67,6 +122,81 @@ func WithRetryWaitMax(d time.Duration) CustomOption {
 	}
 }
 
+// WithRetryPolicy set the policy deciding which errors and responses are retried. Default is retryable.DefaultRetryPolicy.
+func WithRetryPolicy(p retryable.RetryPolicy) CustomOption {
+	return func(config *customConfig) {
+		config.retryPolicy = p
+	}
+}
+
+// WithBackoff set the strategy computing the wait between retries. Default is retryable.ExponentialBackoff.
+func WithBackoff(b retryable.Backoff) CustomOption {
+	return func(config *customConfig) {
+		config.backoff = b
+	}
+}
+
+// WithIdempotencyKey set true to add a generated Idempotency-Key header to non-idempotent requests (POST, PATCH) not having one, so they can be retried.
+// Without it, only idempotent methods and requests carrying an Idempotency-Key header are retried.
+func WithIdempotencyKey(d bool) CustomOption {
+	return func(config *customConfig) {
+		config.idempotencyKey = d
+	}
+}
+
+// WithRetryBudget limits the retries of all the requests of the client to ratio retries per successful first attempt,
+// with a floor of minRetriesPerSecond retries per second.
+func WithRetryBudget(ratio float64, minRetriesPerSecond int) CustomOption {
+	return func(config *customConfig) {
+		config.retryBudget = retryable.NewBudget(ratio, minRetriesPerSecond)
+	}
+}
+
+// WithMaxBufferedBody set the largest request body buffered to be retried when the request has no GetBody. Larger bodies are sent once and never retried.
+func WithMaxBufferedBody(n int64) CustomOption {
+	return func(config *customConfig) {
+		config.maxBufferedBody = n
+	}
+}
+
+// WithAttemptTimeout set time duration for the timeout of each attempt, an attempt timing out is retried. WithTimeout still limits all the attempts.
+func WithAttemptTimeout(d time.Duration) CustomOption {
+	return func(config *customConfig) {
+		config.attemptTimeout = d
+	}
+}
+
+// WithAttemptHeader set true to add the X-Retry-Attempt header, holding the attempt number, to the requests.
+func WithAttemptHeader(d bool) CustomOption {
+	return func(config *customConfig) {
+		config.attemptHeader = d
+	}
+}
+
+// WithOnRetry set a hook called before each retry, e.g. to log it.
+func WithOnRetry(f retryable.OnRetry) CustomOption {
+	return func(config *customConfig) {
+		config.onRetry = f
+	}
+}
+
+// WithHedging enables hedged requests: for idempotent requests, up to maxHedges copies are sent, one each time delay expires without a successful response.
+// Each attempt is hedged, so a request makes up to (1+RetryMax)*(1+maxHedges) calls, unless they are limited by WithRetryBudget.
+func WithHedging(delay time.Duration, maxHedges int) CustomOption {
+	return func(config *customConfig) {
+		config.hedgeDelay = delay
+		config.hedgeMax = maxHedges
+	}
+}
+
+// WithHedgingPercentile sends the hedged requests after the percentile p of the observed latencies (e.g. 0.95) instead of the delay of WithHedging.
+// Without the delay of WithHedging, requests are not hedged until enough latencies are observed.
+func WithHedgingPercentile(p float64) CustomOption {
+	return func(config *customConfig) {
+		config.hedgePercentile = p
+	}
+}
+
 // WithRetryableStats set stats and module name for metrics OTEL.
 func WithRetryableStats(stats *retryable.Stats, moduleName string) CustomOption {
 	return func(config *customConfig) {
@@ -118,6 +248,49 @@ func WithCBConsecutiveFailures(failures uint32) CustomOption {
 	}
 }
 
+// WithCBFailureRatio trips the circuit breaker when at least minRequests requests were made and the ratio of failures reaches ratio, instead of WithCBConsecutiveFailures. Use WithCBInterval to clear the counts periodically, and WithCBBucketPeriod for a rolling window.
+func WithCBFailureRatio(minRequests uint32, ratio float64) CustomOption {
+	return func(config *customConfig) {
+		config.cbMinRequests = minRequests
+		config.cbFailureRatio = ratio
+	}
+}
+
+// WithCBReadyToTrip set a custom function deciding from the counts if the circuit breaker trips, instead of WithCBConsecutiveFailures and WithCBFailureRatio.
+func WithCBReadyToTrip(f func(counts gobreaker.Counts) bool) CustomOption {
+	return func(config *customConfig) {
+		config.cbReadyToTrip = f
+	}
+}
+
+// WithCBInterval set the cyclic period of the closed state for the CircuitBreaker to clear the counts. If WithCBInterval is less than or equal to 0, the CircuitBreaker doesn't clear the counts during the closed state.
+func WithCBInterval(d time.Duration) CustomOption {
+	return func(config *customConfig) {
+		config.cbInterval = d
+	}
+}
+
+// WithCBBucketPeriod set the period of the buckets of a rolling window of WithCBInterval: the counts of the oldest bucket are cleared every period, instead of all the counts every interval. The interval is rounded up to a multiple of the period.
+func WithCBBucketPeriod(d time.Duration) CustomOption {
+	return func(config *customConfig) {
+		config.cbBucketPeriod = d
+	}
+}
+
+// WithCBOnStateChange set a function called whenever the state of a circuit breaker changes, e.g. to log it.
+func WithCBOnStateChange(f func(name string, from gobreaker.State, to gobreaker.State)) CustomOption {
+	return func(config *customConfig) {
+		config.cbOnStateChange = f
+	}
+}
+
+// WithCBFallback set a function serving a response when the circuit breaker rejects a request, e.g. circuitbreaker.StaticFallback.
+func WithCBFallback(f circuitbreaker.Fallback) CustomOption {
+	return func(config *customConfig) {
+		config.cbFallback = f
+	}
+}
+
 // WithCBTimeout set circuit breaker timeout, is the period of the open state, after which the state of the CircuitBreaker becomes half-open. If WithTimeout is less than or equal to 0, the timeout value of the CircuitBreaker is set to 60 seconds.
 func WithCBTimeout(d time.Duration) CustomOption {
 	return func(config *customConfig) {
@@ -139,6 +312,41 @@ func WithCBHTTPSatusCodeMax(d int) CustomOption {
 	}
 }
 
+// WithCBKeyFunc set the function selecting the circuit breaker of a request, one circuit breaker is kept per key. Default is circuitbreaker.HostKey.
+func WithCBKeyFunc(f circuitbreaker.KeyFunc) CustomOption {
+	return func(config *customConfig) {
+		config.cbKeyFunc = f
+	}
+}
+
+// WithCBIdleTimeout set the duration after which an unused closed circuit breaker is evicted. If WithCBIdleTimeout is 0, circuit breakers are never evicted.
+func WithCBIdleTimeout(d time.Duration) CustomOption {
+	return func(config *customConfig) {
+		config.cbIdleTimeout = d
+	}
+}
+
+// WithCBFailureStatusCodes set HTTP status codes, below WithCBHTTPSatusCodeMax, counted as failures by the CircuitBreaker, e.g. 429. The responses are still returned.
+func WithCBFailureStatusCodes(codes ...int) CustomOption {
+	return func(config *customConfig) {
+		config.cbFailureStatusCodes = codes
+	}
+}
+
+// WithCBIsSuccessful set a custom function deciding if the error of a call is counted as a success by the CircuitBreaker, instead of circuitbreaker.IsSuccessful. Error responses are reported as *circuitbreaker.StatusError.
+func WithCBIsSuccessful(f func(err error) bool) CustomOption {
+	return func(config *customConfig) {
+		config.cbIsSuccessful = f
+	}
+}
+
+// WithCBRegistry set the registry holding the circuit breakers of the client, e.g. to serve it with circuitbreaker.Handler.
+func WithCBRegistry(registry *circuitbreaker.Registry) CustomOption {
+	return func(config *customConfig) {
+		config.cbRegistry = registry
+	}
+}
+
 // WithInsecureSkipVerify controls whether a client verifies the server's certificate chain and host name.
 func WithInsecureSkipVerify(d bool) CustomOption {
 	return func(config *customConfig) {
@@ -146,8 +354,196 @@ func WithInsecureSkipVerify(d bool) CustomOption {
 	}
 }
 
+// WithCAFile adds a PEM CA bundle file trusted to verify the server certificates, instead of the system ones. The file is reloaded when it changes.
+func WithCAFile(path string) CustomOption {
+	return func(config *customConfig) {
+		config.tlsSource.CAFiles = append(config.tlsSource.CAFiles, path)
+	}
+}
+
+// WithCAPEM adds a PEM CA bundle trusted to verify the server certificates, instead of the system ones.
+func WithCAPEM(pem []byte) CustomOption {
+	return func(config *customConfig) {
+		config.tlsSource.CAPEMs = append(config.tlsSource.CAPEMs, pem)
+	}
+}
+
+// WithClientCertificate adds a client certificate and its key from PEM files, for mTLS. The files are reloaded when they change.
+func WithClientCertificate(certFile string, keyFile string) CustomOption {
+	return func(config *customConfig) {
+		config.tlsSource.KeyPairs = append(config.tlsSource.KeyPairs, tlsconfig.KeyPair{CertFile: certFile, KeyFile: keyFile})
+	}
+}
+
+// WithClientCertificatePEM adds a PEM client certificate and its key, for mTLS.
+func WithClientCertificatePEM(certPEM []byte, keyPEM []byte) CustomOption {
+	return func(config *customConfig) {
+		config.tlsSource.KeyPairs = append(config.tlsSource.KeyPairs, tlsconfig.KeyPair{CertPEM: certPEM, KeyPEM: keyPEM})
+	}
+}
+
+// WithTLSReloadInterval set the minimum time duration between two checks of the CA and client certificate files for changes.
+func WithTLSReloadInterval(d time.Duration) CustomOption {
+	return func(config *customConfig) {
+		config.tlsReloadInterval = d
+	}
+}
+
+// WithMinTLSVersion set the minimum TLS version, e.g. tls.VersionTLS13.
+func WithMinTLSVersion(v uint16) CustomOption {
+	return func(config *customConfig) {
+		config.tlsMinVersion = v
+	}
+}
+
+// WithCipherSuites set the enabled TLS 1.0–1.2 cipher suites, e.g. tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256.
+func WithCipherSuites(ids ...uint16) CustomOption {
+	return func(config *customConfig) {
+		config.tlsCipherSuites = ids
+	}
+}
+
+// WithServerName set the server name sent with SNI and used to verify the server certificate, instead of the host of the request.
+func WithServerName(name string) CustomOption {
+	return func(config *customConfig) {
+		config.tlsServerName = name
+	}
+}
+
+// WithPinnedPublicKeys pins the public keys of host: a certificate of its chain must have one of the base64 SHA-256 SPKI hashes, see tlsconfig.SPKIHash.
+// host is the host name or IP address of the request URL, not the WithServerName override.
+func WithPinnedPublicKeys(host string, hashes ...string) CustomOption {
+	return func(config *customConfig) {
+		if config.tlsPins == nil {
+			config.tlsPins = make(tlsconfig.Pins)
+		}
+		config.tlsPins[host] = append(config.tlsPins[host], hashes...)
+	}
+}
+
+// WithTLSStats set stats and module name for metrics OTEL.
+func WithTLSStats(stats *tlsconfig.Stats, moduleName string) CustomOption {
+	return func(config *customConfig) {
+		config.tlsStats = stats
+		config.moduleName = moduleName
+	}
+}
+
 func WithProxyHost(d string) CustomOption {
 	return func(config *customConfig) {
 		config.proxyHost = d
 	}
 }
+
+// WithProxy set the proxy URL: http, https or socks5 scheme, with optional user info for the proxy authentication.
+func WithProxy(u *url.URL) CustomOption {
+	return func(config *customConfig) {
+		config.proxyURL = u
+	}
+}
+
+// WithProxyFromEnvironment set the proxy from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+func WithProxyFromEnvironment(d bool) CustomOption {
+	return func(config *customConfig) {
+		config.proxyFromEnvironment = d
+	}
+}
+
+// WithProxyBypass add hosts connected without proxy: host name, ".domain" or "*.domain" suffix, IP, CIDR or "*".
+func WithProxyBypass(hosts ...string) CustomOption {
+	return func(config *customConfig) {
+		config.proxyBypass = append(config.proxyBypass, hosts...)
+	}
+}
+
+// WithProxyConnectHeader set the headers sent to the proxy in CONNECT requests.
+func WithProxyConnectHeader(h http.Header) CustomOption {
+	return func(config *customConfig) {
+		config.proxyConnectHeader = h
+	}
+}
+
+// WithHTTP2 enable HTTP/2 over TLS, the concurrency then limits the in-flight streams per host.
+func WithHTTP2(d bool) CustomOption {
+	return func(config *customConfig) {
+		config.http2 = d
+	}
+}
+
+// WithH2C enable HTTP/2 without TLS (prior knowledge h2c) for http URLs, for internal plaintext services.
+func WithH2C(d bool) CustomOption {
+	return func(config *customConfig) {
+		config.h2c = d
+	}
+}
+
+// WithHTTP2HealthCheck set the HTTP/2 health check: a ping is sent after readIdleTimeout without frame,
+// the connection is closed if there is no answer within pingTimeout.
+func WithHTTP2HealthCheck(readIdleTimeout, pingTimeout time.Duration) CustomOption {
+	return func(config *customConfig) {
+		config.http2ReadIdleTimeout = readIdleTimeout
+		config.http2PingTimeout = pingTimeout
+	}
+}
+
+// WithDiscovery balance the requests to the hosts of services between the endpoints looked up by resolver,
+// e.g. a dialer.Resolver, see discovery.Transport.Services. The requests to the endpoints are not proxied.
+func WithDiscovery(resolver discovery.Resolver, services map[string]string) CustomOption {
+	return func(config *customConfig) {
+		config.discoveryResolver = resolver
+		config.discoveryServices = services
+	}
+}
+
+// WithBalancer set the load balancing strategy between the endpoints of the services.
+func WithBalancer(s discovery.Strategy) CustomOption {
+	return func(config *customConfig) {
+		config.discoveryStrategy = s
+	}
+}
+
+// WithDiscoveryRefreshInterval set the time between the lookups of the endpoints of the services.
+func WithDiscoveryRefreshInterval(d time.Duration) CustomOption {
+	return func(config *customConfig) {
+		config.discoveryRefresh = d
+	}
+}
+
+// WithOutlierDetection eject an endpoint for ejectionTime after consecutiveFailures errors or 5xx responses.
+func WithOutlierDetection(consecutiveFailures int, ejectionTime time.Duration) CustomOption {
+	return func(config *customConfig) {
+		config.outlierMaxFailures = consecutiveFailures
+		config.outlierEjectionTime = ejectionTime
+	}
+}
+
+// WithDiscoveryStats set stats and module name for metrics OTEL.
+func WithDiscoveryStats(stats *discovery.Stats, moduleName string) CustomOption {
+	return func(config *customConfig) {
+		config.discoveryStats = stats
+		config.moduleName = moduleName
+	}
+}
+
+// WithBulkhead set the maximum number of in-flight requests per host, the others are rejected with bulkhead.ErrBulkheadFull.
+func WithBulkhead(maxInFlight int) CustomOption {
+	return func(config *customConfig) {
+		config.bulkheadMaxInFlight = maxInFlight
+	}
+}
+
+// WithBulkheadQueue set the maximum number of requests per host waiting for the bulkhead, and their maximum wait.
+func WithBulkheadQueue(size int, timeout time.Duration) CustomOption {
+	return func(config *customConfig) {
+		config.bulkheadMaxQueue = size
+		config.bulkheadQueueTimeout = timeout
+	}
+}
+
+// WithBulkheadStats set stats and module name for metrics OTEL.
+func WithBulkheadStats(stats *bulkhead.Stats, moduleName string) CustomOption {
+	return func(config *customConfig) {
+		config.bulkheadStats = stats
+		config.moduleName = moduleName
+	}
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// getProxy returns the Proxy function of the transport, nil to connect directly.
+// WithProxy takes precedence over WithProxyHost and WithProxyFromEnvironment.
+func getProxy(config customConfig) func(*http.Request) (*url.URL, error) {
+	var proxy func(*url.URL) (*url.URL, error)
+	switch {
+	case config.proxyURL != nil:
+		proxyURL := config.proxyURL
+		proxy = func(*url.URL) (*url.URL, error) {
+			return proxyURL, nil
+		}
+	case config.proxyHost != "":
+		proxyURL := &url.URL{Scheme: "http", Host: config.proxyHost}
+		proxy = func(*url.URL) (*url.URL, error) {
+			return proxyURL, nil
+		}
+	case config.proxyFromEnvironment:
+		// Read the environment now, http.ProxyFromEnvironment reads it once per process.
+		proxy = httpproxy.FromEnvironment().ProxyFunc()
+	default:
+		return nil
+	}
+
+	bypass := newProxyBypass(config.proxyBypass)
+	return func(r *http.Request) (*url.URL, error) {
+		if bypass.match(r.URL.Hostname()) {
+			return nil, nil
+		}
+		return proxy(r.URL)
+	}
+}
+
+// proxyBypass matches the hosts connected directly, without the proxy.
+type proxyBypass struct {
+	all      bool
+	hosts    map[string]bool
+	suffixes []string
+	networks []*net.IPNet
+}
+
+// newProxyBypass parses the rules of WithProxyBypass.
+func newProxyBypass(rules []string) proxyBypass {
+	bypass := proxyBypass{hosts: make(map[string]bool)}
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if _, network, err := net.ParseCIDR(rule); err == nil {
+			bypass.networks = append(bypass.networks, network)
+			continue
+		}
+		switch {
+		case rule == "":
+		case rule == "*":
+			bypass.all = true
+		case strings.HasPrefix(rule, "*."):
+			bypass.suffixes = append(bypass.suffixes, rule[1:])
+		case strings.HasPrefix(rule, "."):
+			bypass.suffixes = append(bypass.suffixes, rule)
+		default:
+			bypass.hosts[strings.Trim(rule, "[]")] = true
+		}
+	}
+	return bypass
+}
+
+func (b proxyBypass) match(host string) bool {
+	host = strings.ToLower(host)
+	if b.all || b.hosts[host] {
+		return true
+	}
+	for _, suffix := range b.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range b.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
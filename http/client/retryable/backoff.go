@@ -0,0 +1,64 @@
+package retryable
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff returns the duration to wait before the retry number attempt (starting at 0),
+// limited by the minimum and maximum durations. last is the previous wait, 0 for the first retry.
+type Backoff func(minimum, maximum time.Duration, attempt int, last time.Duration) time.Duration
+
+// exponential returns minimum * 2^attempt, limited by maximum.
+func exponential(minimum, maximum time.Duration, attempt int) time.Duration {
+	mult := math.Pow(2, float64(attempt)) * float64(minimum)
+	sleep := time.Duration(mult)
+	if float64(sleep) != mult || sleep > maximum {
+		sleep = maximum
+	}
+	return sleep
+}
+
+// between returns a random duration in [low, high].
+func between(low, high time.Duration) time.Duration {
+	if high <= low {
+		return low
+	}
+	return low + rand.N(high-low+1)
+}
+
+// ExponentialBackoff performs exponential backoff based on the attempt number, without jitter.
+func ExponentialBackoff(minimum, maximum time.Duration, attempt int, _ time.Duration) time.Duration {
+	return exponential(minimum, maximum, attempt)
+}
+
+// FullJitterBackoff waits a random duration between 0 and the exponential backoff.
+func FullJitterBackoff(minimum, maximum time.Duration, attempt int, _ time.Duration) time.Duration {
+	return between(0, exponential(minimum, maximum, attempt))
+}
+
+// EqualJitterBackoff waits half of the exponential backoff plus a random duration up to the other half.
+func EqualJitterBackoff(minimum, maximum time.Duration, attempt int, _ time.Duration) time.Duration {
+	half := exponential(minimum, maximum, attempt) / 2
+	return half + between(0, half)
+}
+
+// DecorrelatedJitterBackoff waits a random duration between minimum and three times the previous wait,
+// limited by maximum.
+func DecorrelatedJitterBackoff(minimum, maximum time.Duration, _ int, last time.Duration) time.Duration {
+	if last < minimum {
+		last = minimum
+	}
+	return min(between(minimum, 3*last), maximum)
+}
+
+// ConstantBackoff always waits minimum.
+func ConstantBackoff(minimum, _ time.Duration, _ int, _ time.Duration) time.Duration {
+	return minimum
+}
+
+// LinearBackoff waits minimum multiplied by the attempt number, limited by maximum.
+func LinearBackoff(minimum, maximum time.Duration, attempt int, _ time.Duration) time.Duration {
+	return min(minimum*time.Duration(attempt+1), maximum)
+}
@@ -0,0 +1,88 @@
+package retryable
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	minimum := 100 * time.Millisecond
+	maximum := 1 * time.Second
+	tests := []struct {
+		name    string
+		backoff Backoff
+		attempt int
+		last    time.Duration
+		low     time.Duration
+		high    time.Duration
+	}{
+		{
+			name:    "exponential",
+			backoff: ExponentialBackoff,
+			attempt: 2,
+			low:     400 * time.Millisecond,
+			high:    400 * time.Millisecond,
+		},
+		{
+			name:    "exponential limited by maximum",
+			backoff: ExponentialBackoff,
+			attempt: 10,
+			low:     maximum,
+			high:    maximum,
+		},
+		{
+			name:    "full jitter",
+			backoff: FullJitterBackoff,
+			attempt: 2,
+			low:     0,
+			high:    400 * time.Millisecond,
+		},
+		{
+			name:    "equal jitter",
+			backoff: EqualJitterBackoff,
+			attempt: 2,
+			low:     200 * time.Millisecond,
+			high:    400 * time.Millisecond,
+		},
+		{
+			name:    "decorrelated jitter first retry",
+			backoff: DecorrelatedJitterBackoff,
+			attempt: 0,
+			low:     minimum,
+			high:    300 * time.Millisecond,
+		},
+		{
+			name:    "decorrelated jitter limited by maximum",
+			backoff: DecorrelatedJitterBackoff,
+			attempt: 5,
+			last:    900 * time.Millisecond,
+			low:     minimum,
+			high:    maximum,
+		},
+		{
+			name:    "constant",
+			backoff: ConstantBackoff,
+			attempt: 5,
+			low:     minimum,
+			high:    minimum,
+		},
+		{
+			name:    "linear",
+			backoff: LinearBackoff,
+			attempt: 2,
+			low:     300 * time.Millisecond,
+			high:    300 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 100 {
+				got := tt.backoff(minimum, maximum, tt.attempt, tt.last)
+				if got < tt.low || got > tt.high {
+					t.Fatalf("backoff() = %v, want between %v and %v", got, tt.low, tt.high)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package retryable
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const (
+	// defaultMaxBufferedBody is the largest request body buffered to be sent again when GetBody is not set.
+	defaultMaxBufferedBody = int64(1 << 20)
+)
+
+func noBody() (io.ReadCloser, error) {
+	return http.NoBody, nil
+}
+
+// prepareBody returns the body of the first attempt of req, and a function returning the body of the next ones.
+// The body is rewound with req.GetBody when set, otherwise it is buffered up to limit bytes.
+// The returned function is nil when the body is larger than limit and can't be rewound.
+func prepareBody(req *http.Request, limit int64) (io.ReadCloser, func() (io.ReadCloser, error), error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req.Body, noBody, nil
+	}
+	if req.GetBody != nil {
+		return req.Body, req.GetBody, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		_ = req.Body.Close()
+		return nil, nil, fmt.Errorf("io.ReadAll: %w", err)
+	}
+	if int64(len(buf)) > limit {
+		// Send the buffered start followed by the rest of the body, once.
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}, nil, nil
+	}
+	_ = req.Body.Close()
+	rewind := func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	body, _ := rewind()
+	return body, rewind, nil
+}
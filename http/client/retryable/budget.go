@@ -0,0 +1,62 @@
+package retryable
+
+import (
+	"sync"
+	"time"
+)
+
+// budgetWindow is the duration of minimum retries a Budget can save.
+const budgetWindow = 10 * time.Second
+
+// Budget limits the retries of all the requests sharing it, to prevent retry storms during an outage.
+// Each successful first attempt deposits ratio retries, and minRetriesPerSecond retries are deposited every second.
+// The balance is capped to the minimum retries of 10 seconds, and at least 10 retries.
+type Budget struct {
+	mu           sync.Mutex
+	ratio        float64
+	minPerSecond float64
+	capacity     float64
+	balance      float64
+	last         time.Time
+}
+
+// NewBudget creates a Budget allowing ratio retries per successful first attempt (e.g. 0.1 for 10%),
+// and at least minRetriesPerSecond retries per second.
+func NewBudget(ratio float64, minRetriesPerSecond int) *Budget {
+	capacity := max(float64(minRetriesPerSecond)*budgetWindow.Seconds(), 10)
+	return &Budget{
+		ratio:        ratio,
+		minPerSecond: float64(minRetriesPerSecond),
+		capacity:     capacity,
+		balance:      capacity,
+		last:         time.Now(),
+	}
+}
+
+// refill adds the minimum retries accrued since the last call, the lock must be held.
+func (b *Budget) refill() {
+	now := time.Now()
+	b.balance = min(b.balance+now.Sub(b.last).Seconds()*b.minPerSecond, b.capacity)
+	b.last = now
+}
+
+// deposit credits the budget for a successful first attempt.
+func (b *Budget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.balance = min(b.balance+b.ratio, b.capacity)
+}
+
+// Withdraw takes one retry from the budget and reports whether it was allowed.
+// The hedged requests withdraw from the budget of the retries too.
+func (b *Budget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
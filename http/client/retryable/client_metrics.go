@@ -10,8 +10,11 @@ import (
 
 // Stats contains accumulated stats.
 type Stats struct {
-	Duration metric.Float64Histogram
-	Retry    metric.Float64Counter
+	Duration              metric.Float64Histogram
+	Retry                 metric.Float64Counter
+	RetryDeadlineExceeded metric.Float64Counter
+	RetryBudgetExhausted  metric.Float64Counter
+	Hedge                 metric.Float64Counter
 }
 
 func GetStats(name string) (*Stats, error) {
@@ -33,8 +36,32 @@ func GetStats(name string) (*Stats, error) {
 		return nil, fmt.Errorf("meter.Float64Counter: %w", err)
 	}
 
+	retryBudgetExhausted, err := meter.Float64Counter(metrics.Namespace+"client_http_retry_budget_exhausted_total",
+		metric.WithDescription("Total number of retry denied by the retry budget"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("meter.Float64Counter: %w", err)
+	}
+
+	hedge, err := meter.Float64Counter(metrics.Namespace+"client_http_hedge_total",
+		metric.WithDescription("Total number of hedged request sent and won"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("meter.Float64Counter: %w", err)
+	}
+
+	retryDeadlineExceeded, err := meter.Float64Counter(metrics.Namespace+"client_http_retry_deadline_exceeded_total",
+		metric.WithDescription("Total number of retry given up because the backoff would exceed the request deadline"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("meter.Float64Counter: %w", err)
+	}
+
 	return &Stats{
-		Duration: duration,
-		Retry:    retry,
+		Duration:              duration,
+		Retry:                 retry,
+		RetryDeadlineExceeded: retryDeadlineExceeded,
+		RetryBudgetExhausted:  retryBudgetExhausted,
+		Hedge:                 hedge,
 	}, nil
 }
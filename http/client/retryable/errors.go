@@ -0,0 +1,5 @@
+package retryable
+
+import "errors"
+
+var ErrAttemptTimeout = errors.New("attempt timeout")
@@ -0,0 +1,176 @@
+package retryable
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"syscall"
+
+	"github.com/treussart/articles/http/client/tlsconfig"
+)
+
+var (
+	// A regular expression to match the error returned by net/http when the
+	// configured number of redirects is exhausted. This error isn't typed
+	// specifically so we resort to matching on the error string.
+	redirectsErrorRe = regexp.MustCompile(`stopped after \d+ redirects\z`)
+
+	// A regular expression to match the error returned by net/http when the
+	// scheme specified in the URL is invalid. This error isn't typed
+	// specifically so we resort to matching on the error string.
+	schemeErrorRe = regexp.MustCompile(`unsupported protocol scheme`)
+
+	// A regular expression to match the error returned by net/http when a
+	// request header or value is invalid. This error isn't typed
+	// specifically so we resort to matching on the error string.
+	invalidHeaderErrorRe = regexp.MustCompile(`invalid header`)
+
+	// A regular expression to match the error returned by net/http when the
+	// TLS certificate is not trusted. This error isn't typed
+	// specifically so we resort to matching on the error string.
+	notTrustedErrorRe = regexp.MustCompile(`certificate is not trusted`)
+)
+
+// RetryPolicy reports whether an attempt that returned err or resp should be retried.
+type RetryPolicy func(err error, resp *http.Response) bool
+
+// ErrorClass reports whether an error belongs to a class of transient errors.
+type ErrorClass func(err error) bool
+
+func isCertError(err error) bool {
+	var certificateVerificationError *tls.CertificateVerificationError
+	ok := errors.As(err, &certificateVerificationError)
+	return ok
+}
+
+// isPermanentError reports whether err can't be fixed by sending the request again.
+func isPermanentError(err error) bool {
+	// Don't retry if the error was due to TLS cert verification or pinning failure.
+	if isCertError(err) || errors.Is(err, tlsconfig.ErrPinMismatch) {
+		return true
+	}
+
+	var v *url.Error
+	if errors.As(err, &v) {
+		// Don't retry if the error was due to too many redirects.
+		if redirectsErrorRe.MatchString(v.Error()) {
+			return true
+		}
+
+		// Don't retry if the error was due to an invalid protocol scheme.
+		if schemeErrorRe.MatchString(v.Error()) {
+			return true
+		}
+
+		// Don't retry if the error was due to an invalid header.
+		if invalidHeaderErrorRe.MatchString(v.Error()) {
+			return true
+		}
+
+		// Don't retry if the error was due to TLS cert verification failure.
+		if notTrustedErrorRe.MatchString(v.Error()) {
+			return true
+		}
+		if isCertError(v.Err) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultRetryPolicy retries on every error except the permanent ones (redirects, scheme,
+// header and certificate errors) and on 500-range responses except 501.
+func DefaultRetryPolicy(err error, resp *http.Response) bool {
+	if err != nil {
+		return !isPermanentError(err)
+	}
+
+	// Check the response code. We retry on 500-range responses to allow
+	// the server time to recover, as 500's are typically not permanent
+	// errors and may relate to outages on the server side. This will catch
+	// invalid response codes as well, like 0 and 999.
+	if resp.StatusCode == 0 || (resp.StatusCode >= http.StatusInternalServerError && resp.StatusCode != http.StatusNotImplemented) {
+		return true
+	}
+
+	return false
+}
+
+// TimeoutErrors matches deadline and network timeout errors.
+func TimeoutErrors(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// ConnectionErrors matches refused, reset and prematurely closed connections.
+func ConnectionErrors(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// DNSErrors matches name resolution failures, except for unknown hosts.
+func DNSErrors(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && !dnsErr.IsNotFound
+}
+
+type policy struct {
+	statusCodes  map[int]struct{}
+	errorClasses []ErrorClass
+}
+
+// PolicyOption configures a RetryPolicy built by NewRetryPolicy.
+type PolicyOption func(*policy)
+
+// RetryOnStatusCodes retries the responses having one of the status codes, e.g. 408, 425, 429, 502, 503, 504.
+func RetryOnStatusCodes(codes ...int) PolicyOption {
+	return func(p *policy) {
+		for _, code := range codes {
+			p.statusCodes[code] = struct{}{}
+		}
+	}
+}
+
+// RetryOnErrors retries the errors matching one of the classes, e.g. TimeoutErrors, ConnectionErrors.
+func RetryOnErrors(classes ...ErrorClass) PolicyOption {
+	return func(p *policy) {
+		p.errorClasses = append(p.errorClasses, classes...)
+	}
+}
+
+// NewRetryPolicy builds a RetryPolicy retrying only the listed status codes and error classes.
+// Permanent errors are never retried.
+func NewRetryPolicy(options ...PolicyOption) RetryPolicy {
+	p := &policy{
+		statusCodes: make(map[int]struct{}),
+	}
+	for _, opt := range options {
+		opt(p)
+	}
+	return func(err error, resp *http.Response) bool {
+		if err != nil {
+			if isPermanentError(err) {
+				return false
+			}
+			for _, class := range p.errorClasses {
+				if class(err) {
+					return true
+				}
+			}
+			return false
+		}
+		_, ok := p.statusCodes[resp.StatusCode]
+		return ok
+	}
+}
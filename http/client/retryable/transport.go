@@ -1,49 +1,37 @@
 package retryable
 
 import (
-	"bytes"
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"net/http"
-	"net/url"
-	"regexp"
 	"strconv"
 	"time"
 
+	"github.com/treussart/articles/http/client/internal/body"
 	"github.com/treussart/articles/http/client/metrics"
+	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	api "go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	defaultRespReadLimit = int64(4096)
+	tracerName           = "github.com/treussart/articles/http/client/retryable"
+	resendCountAttribute = "http.request.resend_count"
+	backoffAttribute     = "http.request.backoff_ms"
+	statusCodeAttribute  = "http.response.status_code"
 )
 
-var (
-	// A regular expression to match the error returned by net/http when the
-	// configured number of redirects is exhausted. This error isn't typed
-	// specifically so we resort to matching on the error string.
-	redirectsErrorRe = regexp.MustCompile(`stopped after \d+ redirects\z`)
-
-	// A regular expression to match the error returned by net/http when the
-	// scheme specified in the URL is invalid. This error isn't typed
-	// specifically so we resort to matching on the error string.
-	schemeErrorRe = regexp.MustCompile(`unsupported protocol scheme`)
-
-	// A regular expression to match the error returned by net/http when a
-	// request header or value is invalid. This error isn't typed
-	// specifically so we resort to matching on the error string.
-	invalidHeaderErrorRe = regexp.MustCompile(`invalid header`)
-
-	// A regular expression to match the error returned by net/http when the
-	// TLS certificate is not trusted. This error isn't typed
-	// specifically so we resort to matching on the error string.
-	notTrustedErrorRe = regexp.MustCompile(`certificate is not trusted`)
-)
+// AttemptHeader is the header holding the attempt number of a request, 0 for the first one.
+const AttemptHeader = "X-Retry-Attempt"
+
+// OnRetry is called before waiting for a retry, with the retry number (starting at 1),
+// the request and the failed attempt result. The response body is drained after it returns.
+type OnRetry func(attempt int, req *http.Request, resp *http.Response, err error, wait time.Duration)
 
 // Transport handles HTTP transactions with configurable retry policy and stats recording.
 type Transport struct {
@@ -51,8 +39,28 @@ type Transport struct {
 	RetryMax     int
 	RetryWaitMin time.Duration
 	RetryWaitMax time.Duration
-	Stats        *Stats
-	ModuleName   string
+	// RetryPolicy decides if an attempt is retried, DefaultRetryPolicy is used if nil.
+	RetryPolicy RetryPolicy
+	// Backoff computes the wait before a retry, ExponentialBackoff is used if nil.
+	// The Retry-After header of 429 and 503 responses takes precedence.
+	Backoff Backoff
+	// GenerateIdempotencyKey sets a random Idempotency-Key header on non-idempotent requests not having one,
+	// so they can be retried. The key is the same for all the attempts of a request.
+	GenerateIdempotencyKey bool
+	// Budget limits the retries of all the requests sharing it, retries are unlimited if nil.
+	Budget *Budget
+	// MaxBufferedBody is the largest request body buffered to be retried when GetBody is not set, 1 MiB if 0.
+	// Larger bodies are sent once and never retried.
+	MaxBufferedBody int64
+	// AttemptTimeout limits each attempt, including the read of its response body, 0 means no limit.
+	// An attempt timing out is retried, the request deadline still applies to all the attempts.
+	AttemptTimeout time.Duration
+	// AttemptHeader adds the X-Retry-Attempt header to every attempt.
+	AttemptHeader bool
+	// OnRetry is called before each retry if set.
+	OnRetry    OnRetry
+	Stats      *Stats
+	ModuleName string
 }
 
 // parseRetryAfterHeader parses the Retry-After header and returns the
@@ -90,77 +98,90 @@ func parseRetryAfterHeader(headers []string) (time.Duration, bool) {
 	return 0, true
 }
 
-// DefaultBackoff provides a default callback for Client.Backoff which
-// will perform exponential backoff based on the attempt number and limited
-// by the provided minimum and maximum durations.
-func backoff(minimum, maximum time.Duration, retries int, resp *http.Response) time.Duration {
-	if resp != nil {
-		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
-			if sleep, ok := parseRetryAfterHeader(resp.Header["Retry-After"]); ok {
-				return sleep
-			}
-		}
+// retryAfter returns the delay requested by the Retry-After header of 429 and 503 responses.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
 	}
-	mult := math.Pow(2, float64(retries)) * float64(minimum)
-	sleep := time.Duration(mult)
-	if float64(sleep) != mult || sleep > maximum {
-		sleep = maximum
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
 	}
-	return sleep
+	return parseRetryAfterHeader(resp.Header["Retry-After"])
 }
 
-func isCertError(err error) bool {
-	var certificateVerificationError *tls.CertificateVerificationError
-	ok := errors.As(err, &certificateVerificationError)
-	return ok
+// sleep waits for d, or returns the context error as soon as ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("ctx.Done: %w", ctx.Err())
+	case <-timer.C:
+		return nil
+	}
 }
 
-func shouldRetry(err error, resp *http.Response) bool {
-	if err != nil {
-		var v *url.Error
-		if errors.As(err, &v) {
-			// Don't retry if the error was due to too many redirects.
-			if redirectsErrorRe.MatchString(v.Error()) {
-				return false
-			}
-
-			// Don't retry if the error was due to an invalid protocol scheme.
-			if schemeErrorRe.MatchString(v.Error()) {
-				return false
-			}
-
-			// Don't retry if the error was due to an invalid header.
-			if invalidHeaderErrorRe.MatchString(v.Error()) {
-				return false
-			}
-
-			// Don't retry if the error was due to TLS cert verification failure.
-			if notTrustedErrorRe.MatchString(v.Error()) {
-				return false
-			}
-			if isCertError(v.Err) {
-				return false
-			}
-		}
+// shouldRetry applies the retry policy, an attempt timing out is always retried.
+func (t *Transport) shouldRetry(err error, resp *http.Response) bool {
+	if errors.Is(err, ErrAttemptTimeout) {
 		return true
 	}
-
-	// Check the response code. We retry on 500-range responses to allow
-	// the server time to recover, as 500's are typically not permanent
-	// errors and may relate to outages on the server side. This will catch
-	// invalid response codes as well, like 0 and 999.
-	if resp.StatusCode == 0 || (resp.StatusCode >= http.StatusInternalServerError && resp.StatusCode != http.StatusNotImplemented) {
-		return true
+	if t.RetryPolicy != nil {
+		return t.RetryPolicy(err, resp)
 	}
+	return DefaultRetryPolicy(err, resp)
+}
 
-	return false
+func (t *Transport) backoff() Backoff {
+	if t.Backoff != nil {
+		return t.Backoff
+	}
+	return ExponentialBackoff
 }
 
-func drainBody(resp *http.Response) {
-	if resp != nil && resp.Body != nil {
-		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, defaultRespReadLimit))
-		_ = resp.Body.Close()
+// attempt sends the attempt number n (0 for the first one) of req with reqBody, in its own span.
+// wait is the backoff that preceded it, the attempt is limited by AttemptTimeout.
+func (t *Transport) attempt(req *http.Request, reqBody io.ReadCloser, n int, wait time.Duration) (*http.Response, error) {
+	ctx, span := otel.Tracer(tracerName).Start(req.Context(), "HTTP attempt",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.Int(resendCountAttribute, n),
+			attribute.Int64(backoffAttribute, wait.Milliseconds()),
+		))
+	defer span.End()
+
+	cancel := context.CancelFunc(func() {})
+	if t.AttemptTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.AttemptTimeout)
+	}
+	r := req.Clone(ctx)
+	r.Body = reqBody
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
+	if t.AttemptHeader {
+		r.Header.Set(AttemptHeader, strconv.Itoa(n))
+	}
+
+	resp, err := t.Tripper.RoundTrip(r)
+	if err != nil {
+		cancel()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && req.Context().Err() == nil {
+			return nil, fmt.Errorf("%w: %w", ErrAttemptTimeout, err)
+		}
+		return nil, fmt.Errorf("t.Tripper.RoundTrip: %w", err)
+	}
+	span.SetAttributes(attribute.Int(statusCodeAttribute, resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	if resp.Body == nil {
+		cancel()
+		return resp, nil
 	}
+	// The context of the attempt is cancelled when its response body is closed.
+	resp.Body = body.OnClose(resp.Body, cancel)
+	return resp, nil
 }
 
 // RoundTrip executes a single HTTP transaction and retries on failure based on the configured retry policy.
@@ -172,33 +193,85 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		))
 	}
 
-	// Clone the request body
-	var bodyBytes []byte
-	if req.Body != nil {
-		bodyBytes, _ = io.ReadAll(req.Body)
-		req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	// Only requests that can be replayed safely are retried.
+	if t.GenerateIdempotencyKey && !IsIdempotent(req) {
+		key, err := newIdempotencyKey()
+		if err != nil {
+			return nil, fmt.Errorf("newIdempotencyKey: %w", err)
+		}
+		req = req.Clone(req.Context())
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	idempotent := IsIdempotent(req)
+
+	// Rewind the request body for each attempt
+	limit := t.MaxBufferedBody
+	if limit <= 0 {
+		limit = defaultMaxBufferedBody
+	}
+	reqBody, rewind, err := prepareBody(req, limit)
+	if err != nil {
+		return nil, fmt.Errorf("prepareBody: %w", err)
 	}
 
 	// Send the request
-	resp, err := t.Tripper.RoundTrip(req)
+	resp, err := t.attempt(req, reqBody, 0, 0)
+
+	if t.Budget != nil && !t.shouldRetry(err, resp) {
+		t.Budget.deposit()
+	}
 
 	// Retry logic
 	retries := 0
-	for shouldRetry(err, resp) && retries < t.RetryMax {
+	var wait time.Duration
+	for idempotent && rewind != nil && t.shouldRetry(err, resp) && retries < t.RetryMax {
+		if req.Context().Err() != nil {
+			break
+		}
+		if sleep, ok := retryAfter(resp); ok {
+			wait = sleep
+		} else {
+			wait = t.backoff()(t.RetryWaitMin, t.RetryWaitMax, retries, wait)
+		}
+
+		// Don't start an attempt that could not complete before the deadline.
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) <= wait {
+			if t.Stats != nil {
+				t.Stats.RetryDeadlineExceeded.Add(context.Background(), 1, api.WithAttributes(
+					attribute.String(metrics.PKGLabelName, t.ModuleName)))
+			}
+			break
+		}
+		if t.Budget != nil && !t.Budget.Withdraw() {
+			if t.Stats != nil {
+				t.Stats.RetryBudgetExhausted.Add(context.Background(), 1, api.WithAttributes(
+					attribute.String(metrics.PKGLabelName, t.ModuleName)))
+			}
+			break
+		}
 		if t.Stats != nil {
 			t.Stats.Retry.Add(context.Background(), 1, api.WithAttributes(
 				attribute.String(metrics.PKGLabelName, t.ModuleName)))
 		}
-		// Wait for the specified backoff period
-		time.Sleep(backoff(t.RetryWaitMin, t.RetryWaitMax, retries, resp))
+		if t.OnRetry != nil {
+			t.OnRetry(retries+1, req, resp, err, wait)
+		}
 
 		// We're going to retry, consume any response to reuse the connection.
-		drainBody(resp)
+		body.Drain(resp)
 
-		// Retry the request
-		resp, err = t.Tripper.RoundTrip(req)
+		// Wait for the specified backoff period
+		if err := sleep(req.Context(), wait); err != nil {
+			return nil, fmt.Errorf("sleep: %w", err)
+		}
 
+		// Retry the request
+		reqBody, err = rewind()
+		if err != nil {
+			return nil, fmt.Errorf("rewind: %w", err)
+		}
 		retries++
+		resp, err = t.attempt(req, reqBody, retries, wait)
 	}
 	if err != nil {
 		return resp, fmt.Errorf("t.transport.RoundTrip: %w", err)
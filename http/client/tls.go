@@ -0,0 +1,173 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+
+	"github.com/treussart/articles/http/client/tlsconfig"
+)
+
+// verifyFunc returns a tls.Config.VerifyConnection for a connection to host with serverName,
+// both are taken from the connection state if empty.
+type verifyFunc func(serverName, host string) func(cs tls.ConnectionState) error
+
+// getTLSConfig returns the TLS configuration of the transport, nil to use the default one,
+// and the verification of the connections when it is not done by crypto/tls.
+func getTLSConfig(config customConfig) (*tls.Config, verifyFunc) {
+	reloader := tlsconfig.NewReloader(config.tlsSource, config.tlsReloadInterval)
+	if !config.insecureSkipVerify && !reloader.HasRoots() && !reloader.HasCertificates() && len(config.tlsPins) == 0 &&
+		config.tlsMinVersion == 0 && len(config.tlsCipherSuites) == 0 && config.tlsServerName == "" {
+		return nil, nil
+	}
+
+	//nolint: gosec
+	tlsConfig := &tls.Config{
+		MinVersion:         config.tlsMinVersion,
+		CipherSuites:       config.tlsCipherSuites,
+		ServerName:         config.tlsServerName,
+		InsecureSkipVerify: config.insecureSkipVerify,
+	}
+	if reloader.HasCertificates() {
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
+	verifyChains := reloader.HasRoots() && !config.insecureSkipVerify
+	if verifyChains {
+		// The chain is verified by VerifyConnection, against the reloaded CA bundles.
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if !verifyChains && len(config.tlsPins) == 0 {
+		return tlsConfig, nil
+	}
+
+	verify := func(serverName, host string) func(cs tls.ConnectionState) error {
+		verifyPins := config.tlsPins.VerifyConnection(host, config.tlsStats, config.moduleName)
+		return func(cs tls.ConnectionState) error {
+			if verifyChains {
+				name := serverName
+				if name == "" {
+					name = cs.ServerName
+				}
+				chains, err := reloader.VerifyChains(cs, name)
+				if err != nil {
+					return fmt.Errorf("reloader.VerifyChains: %w", err)
+				}
+				cs.VerifiedChains = chains
+			}
+			return verifyPins(cs)
+		}
+	}
+	// The connections tunneled through a proxy are not dialed by dialTLS, they are sent by proxiedTLS
+	// with a configuration per host. Without the host, the chains are verified against the server name,
+	// rejected if it is empty, and the pins are rejected.
+	tlsConfig.VerifyConnection = verify("", "")
+	return tlsConfig, verify
+}
+
+// dialTLS returns a http.Transport.DialTLSContext verifying the chains against the server name, the dialed host
+// if it is not set, and the pins of the dialed host. The connection state doesn't have the host for IP addresses.
+func dialTLS(tr *http.Transport, verify verifyFunc) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("net.SplitHostPort: %w", err)
+		}
+		dial := tr.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("tr.DialContext: %w", err)
+		}
+
+		// The config is cloned at dial time, once HTTP/2 added its protocols.
+		tlsConn := tls.Client(conn, tlsConfigFor(tr.TLSClientConfig, verify, host))
+
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		err = tlsConn.HandshakeContext(ctx)
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+		}
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("tlsConn.HandshakeContext: %w", err)
+		}
+		return tlsConn, nil
+	}
+}
+
+// tlsConfigFor returns a copy of tlsConfig verifying the connections to host.
+func tlsConfigFor(tlsConfig *tls.Config, verify verifyFunc, host string) *tls.Config {
+	cfg := tlsConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	cfg.VerifyConnection = verify(cfg.ServerName, host)
+	return cfg
+}
+
+// proxiedTLS sends the HTTPS requests tunneled through a proxy with a transport per host,
+// its TLS configuration verifies the connections against the host since they are not dialed by dialTLS.
+// The other requests are sent by Tripper.
+type proxiedTLS struct {
+	Tripper    http.RoundTripper
+	Proxy      func(*http.Request) (*url.URL, error)
+	NewTripper func(host string) http.RoundTripper
+
+	mu       sync.Mutex
+	trippers map[string]http.RoundTripper
+}
+
+func (t *proxiedTLS) tripper(req *http.Request) http.RoundTripper {
+	if req.URL.Scheme != "https" {
+		return t.Tripper
+	}
+	if proxyURL, err := t.Proxy(req); err != nil || proxyURL == nil {
+		return t.Tripper
+	}
+	host := req.URL.Hostname()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.trippers == nil {
+		t.trippers = make(map[string]http.RoundTripper)
+	}
+	tripper, ok := t.trippers[host]
+	if !ok {
+		tripper = t.NewTripper(host)
+		t.trippers[host] = tripper
+	}
+	return tripper
+}
+
+// RoundTrip implements http.RoundTripper interface.
+func (t *proxiedTLS) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.tripper(req).RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("t.tripper.RoundTrip: %w", err)
+	}
+	return res, nil
+}
+
+// CloseIdleConnections closes the idle connections of the transports.
+func (t *proxiedTLS) CloseIdleConnections() {
+	type closeIdler interface{ CloseIdleConnections() }
+	if tr, ok := t.Tripper.(closeIdler); ok {
+		tr.CloseIdleConnections()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tripper := range t.trippers {
+		if tr, ok := tripper.(closeIdler); ok {
+			tr.CloseIdleConnections()
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package tlsconfig
+
+import (
+	"fmt"
+
+	"github.com/treussart/articles/http/client/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Stats contains accumulated stats.
+type Stats struct {
+	PinFailure metric.Float64Counter
+}
+
+func GetStats(name string) (*Stats, error) {
+	meter := otel.GetMeterProvider().Meter(name)
+	pinFailure, err := meter.Float64Counter(metrics.Namespace+"client_http_pin_failure_total",
+		metric.WithDescription("Total number of TLS connections rejected because no public key matches the pins"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("meter.Float64Counter: %w", err)
+	}
+
+	return &Stats{
+		PinFailure: pinFailure,
+	}, nil
+}
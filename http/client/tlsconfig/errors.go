@@ -0,0 +1,8 @@
+package tlsconfig
+
+import "errors"
+
+var ErrNoCertificate = errors.New("no certificate found in CA bundle")
+var ErrNoPeerCertificate = errors.New("no peer certificate")
+var ErrPinMismatch = errors.New("no public key matches the pins")
+var ErrNoServerName = errors.New("no server name to verify")
@@ -0,0 +1,61 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/treussart/articles/http/client/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	api "go.opentelemetry.io/otel/metric"
+)
+
+// Pins maps host names to the pinned hashes of their public keys, see SPKIHash.
+type Pins map[string][]string
+
+// SPKIHash returns the base64 encoded SHA-256 hash of the public key (SPKI) of cert.
+// Pins may also be written with the "sha256/" prefix, like in HPKP.
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// VerifyConnection returns a tls.Config.VerifyConnection checking that a certificate of the peer chain
+// matches a pin of host, the dialed host name or IP address. Hosts without pins are not checked,
+// but an empty host is rejected if there are pins, as the connection may be to a pinned host.
+// Without verified chains, only the leaf certificate is matched, as the other certificates sent
+// by the peer are not authenticated.
+func (p Pins) VerifyConnection(host string, stats *Stats, moduleName string) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		pins, ok := p[host]
+		if !ok && (host != "" || len(p) == 0) {
+			return nil
+		}
+		var certs []*x509.Certificate
+		if len(cs.VerifiedChains) > 0 {
+			certs = slices.Concat(cs.VerifiedChains...)
+		} else if len(cs.PeerCertificates) > 0 {
+			certs = cs.PeerCertificates[:1]
+		}
+		for _, cert := range certs {
+			hash := SPKIHash(cert)
+			for _, pin := range pins {
+				if strings.TrimPrefix(pin, "sha256/") == hash {
+					return nil
+				}
+			}
+		}
+		if stats != nil {
+			stats.PinFailure.Add(context.Background(), 1, api.WithAttributes(
+				attribute.String(metrics.PKGLabelName, moduleName),
+				attribute.String(metrics.HostLabelName, host),
+			))
+		}
+		return fmt.Errorf("%w: %s", ErrPinMismatch, host)
+	}
+}
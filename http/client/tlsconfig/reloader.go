@@ -0,0 +1,213 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// KeyPair is a client certificate and its private key, PEM encoded, from files or bytes.
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+	CertPEM  []byte
+	KeyPEM   []byte
+}
+
+// Source lists the CA bundles and client certificates of a Reloader.
+type Source struct {
+	CAFiles  []string
+	CAPEMs   [][]byte
+	KeyPairs []KeyPair
+}
+
+// Reloader provides the CA bundles and client certificates of a tls.Config,
+// reloading them when their files change.
+type Reloader struct {
+	source   Source
+	interval time.Duration
+
+	mu        sync.Mutex
+	roots     *x509.CertPool
+	certs     []tls.Certificate
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+// NewReloader creates a Reloader of source, checking its files for changes at most once per interval.
+// Files are loaded on the first TLS handshake, errors are returned by the handshakes.
+func NewReloader(source Source, interval time.Duration) *Reloader {
+	return &Reloader{
+		source:   source,
+		interval: interval,
+		modTimes: make(map[string]time.Time),
+	}
+}
+
+// HasRoots reports whether CA bundles are configured.
+func (r *Reloader) HasRoots() bool {
+	return len(r.source.CAFiles) > 0 || len(r.source.CAPEMs) > 0
+}
+
+// HasCertificates reports whether client certificates are configured.
+func (r *Reloader) HasCertificates() bool {
+	return len(r.source.KeyPairs) > 0
+}
+
+func (r *Reloader) files() []string {
+	files := append([]string(nil), r.source.CAFiles...)
+	for _, pair := range r.source.KeyPairs {
+		if pair.CertFile != "" {
+			files = append(files, pair.CertFile, pair.KeyFile)
+		}
+	}
+	return files
+}
+
+// changed reports whether a file was modified since the last load, the lock must be held.
+func (r *Reloader) changed() (bool, map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	changed := false
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, nil, fmt.Errorf("os.Stat: %w", err)
+		}
+		modTimes[file] = info.ModTime()
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			changed = true
+		}
+	}
+	return changed, modTimes, nil
+}
+
+func (r *Reloader) load() (*x509.CertPool, []tls.Certificate, error) {
+	var roots *x509.CertPool
+	if r.HasRoots() {
+		roots = x509.NewCertPool()
+		bundles := append([][]byte(nil), r.source.CAPEMs...)
+		for _, file := range r.source.CAFiles {
+			bundle, err := os.ReadFile(file)
+			if err != nil {
+				return nil, nil, fmt.Errorf("os.ReadFile: %w", err)
+			}
+			bundles = append(bundles, bundle)
+		}
+		for _, bundle := range bundles {
+			if !roots.AppendCertsFromPEM(bundle) {
+				return nil, nil, ErrNoCertificate
+			}
+		}
+	}
+
+	certs := make([]tls.Certificate, 0, len(r.source.KeyPairs))
+	for _, pair := range r.source.KeyPairs {
+		var cert tls.Certificate
+		var err error
+		if pair.CertFile != "" {
+			cert, err = tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("tls.LoadX509KeyPair: %w", err)
+			}
+		} else {
+			cert, err = tls.X509KeyPair(pair.CertPEM, pair.KeyPEM)
+			if err != nil {
+				return nil, nil, fmt.Errorf("tls.X509KeyPair: %w", err)
+			}
+		}
+		certs = append(certs, cert)
+	}
+	return roots, certs, nil
+}
+
+// current returns the CA pool and client certificates, reloaded if their files changed.
+// The previous ones are kept if the files can't be reloaded.
+func (r *Reloader) current() (*x509.CertPool, []tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	loaded := !r.lastCheck.IsZero()
+	now := time.Now()
+	if loaded && now.Sub(r.lastCheck) < r.interval {
+		return r.roots, r.certs, nil
+	}
+	r.lastCheck = now
+
+	changed, modTimes, err := r.changed()
+	if err == nil && loaded && !changed {
+		return r.roots, r.certs, nil
+	}
+	if err == nil {
+		var roots *x509.CertPool
+		var certs []tls.Certificate
+		roots, certs, err = r.load()
+		if err == nil {
+			r.roots, r.certs, r.modTimes = roots, certs, modTimes
+			return r.roots, r.certs, nil
+		}
+	}
+	if !loaded {
+		// Nothing to fall back to, retry on the next handshake.
+		r.lastCheck = time.Time{}
+		return nil, nil, err
+	}
+	return r.roots, r.certs, nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate, returning the first certificate
+// supported by the server.
+func (r *Reloader) GetClientCertificate(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	_, certs, err := r.current()
+	if err != nil {
+		return nil, fmt.Errorf("r.current: %w", err)
+	}
+	for i := range certs {
+		if cri.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i], nil
+		}
+	}
+	// No certificate, the server decides if it is acceptable.
+	return new(tls.Certificate), nil
+}
+
+// VerifyConnection implements tls.Config.VerifyConnection, verifying the peer certificate chain
+// and server name against the CA bundles. It must be used with InsecureSkipVerify, so the CA bundles can change.
+// IP addresses are not sent as server name, so their connections are rejected, see VerifyChains.
+func (r *Reloader) VerifyConnection(cs tls.ConnectionState) error {
+	if _, err := r.VerifyChains(cs, cs.ServerName); err != nil {
+		return fmt.Errorf("r.VerifyChains: %w", err)
+	}
+	return nil
+}
+
+// VerifyChains verifies the peer certificate chain of cs for serverName, the dialed host name or IP address,
+// and returns the verified chains.
+func (r *Reloader) VerifyChains(cs tls.ConnectionState, serverName string) ([][]*x509.Certificate, error) {
+	roots, _, err := r.current()
+	if err != nil {
+		return nil, fmt.Errorf("r.current: %w", err)
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return nil, ErrNoPeerCertificate
+	}
+	if serverName == "" {
+		// Without a name, x509 verification would accept a certificate of any host.
+		return nil, &tls.CertificateVerificationError{UnverifiedCertificates: cs.PeerCertificates, Err: ErrNoServerName}
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return nil, &tls.CertificateVerificationError{UnverifiedCertificates: cs.PeerCertificates, Err: err}
+	}
+	return chains, nil
+}